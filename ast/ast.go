@@ -75,8 +75,10 @@ func (rs *RSelector) expression() {}
 func (rs *RSelector) String() string {
 	var sb strings.Builder
 
-	sb.WriteString(rs.Token.Literal)
-	sb.WriteString(" ")
+	if rs.Token.Type != token.S {
+		sb.WriteString(rs.Token.Literal)
+		sb.WriteString(" ")
+	}
 	if rs.Expr != nil {
 		sb.WriteString(rs.Expr.String())
 	}
@@ -89,13 +91,17 @@ func (rs *RSelector) String() string {
 //   		 | simple_sequence+
 type Sequence struct {
 	Expression
-	Exprs []Expression
+	Exprs     []Expression
+	Namespace *Namespace
 }
 
 func (s *Sequence) expression() {}
 func (s *Sequence) String() string {
 	var sb strings.Builder
 
+	if s.Namespace != nil {
+		sb.WriteString(s.Namespace.String())
+	}
 	if s.Expression != nil {
 		sb.WriteString(s.Expression.String())
 	}
@@ -106,6 +112,20 @@ func (s *Sequence) String() string {
 	return sb.String()
 }
 
+// Namespace ::= [ IDENT | '*' ]? '|'
+// Prefix is "*" for any namespace and "" for no namespace.
+type Namespace struct {
+	Prefix string
+}
+
+func (ns *Namespace) expression() {}
+func (ns *Namespace) String() string {
+	if ns.Prefix == "*" {
+		return "*|"
+	}
+	return escapeIdent(ns.Prefix) + "|"
+}
+
 // Universal ::= '*'
 type Universal struct {
 	Token token.Token
@@ -123,7 +143,7 @@ type Class struct {
 
 func (c *Class) expression() {}
 func (c *Class) String() string {
-	return fmt.Sprintf(".%s", c.Name)
+	return fmt.Sprintf(".%s", escapeIdent(c.Name))
 }
 
 // Hash ::= '#' Name
@@ -133,7 +153,51 @@ type Hash struct {
 
 func (h *Hash) expression() {}
 func (h *Hash) String() string {
-	return fmt.Sprintf("#%s", h.Name)
+	return fmt.Sprintf("#%s", escapeIdent(h.Name))
+}
+
+// escapeIdent serializes name as a css identifier
+// following https://drafts.csswg.org/cssom/#serialize-an-identifier
+func escapeIdent(name string) string {
+	var sb strings.Builder
+	for i, r := range name {
+		switch {
+		case r == 0:
+			sb.WriteRune('\uFFFD')
+		case r <= 0x1f || r == 0x7f || '0' <= r && r <= '9' && (i == 0 || i == 1 && name[0] == '-'):
+			fmt.Fprintf(&sb, "\\%x ", r)
+		case i == 0 && r == '-' && len(name) == 1:
+			sb.WriteString("\\-")
+		case r >= 0x80 || r == '-' || r == '_' || '0' <= r && r <= '9' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z':
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune('\\')
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// quoteString serializes s as a double-quoted css string
+// that is tokenized back to s.
+func quoteString(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == 0:
+			sb.WriteRune('\uFFFD')
+		case r <= 0x1f || r == 0x7f:
+			fmt.Fprintf(&sb, "\\%x ", r)
+		case r == '"' || r == '\\':
+			sb.WriteRune('\\')
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
 }
 
 // Attrib ::= '[' AttrExpr ']'
@@ -152,27 +216,37 @@ func (a *Attrib) String() string {
 //            SUBSTRINGMATCH |
 //            '=' |
 //            INCLUDES |
-//            DASHMATCH ] S* [ IDENT | STRING ] S*
+//            DASHMATCH ] S* [ IDENT | STRING ] S* [ 'i' | 's' ]? S*
 //        ]?
 type AttrExpr struct {
 	Left, Right *Ident
 	Token       token.Token
 	TypeID      byte
+	Modifier    string // "i", "s" or ""
+	Namespace   *Namespace
 }
 
 func (ae *AttrExpr) expression() {}
 func (ae *AttrExpr) String() string {
+	var ns string
+	if ae.Namespace != nil {
+		ns = ae.Namespace.String()
+	}
+
 	switch ae.TypeID {
 	case 1:
-		return ae.Left.String()
+		return ns + ae.Left.String()
 	case 2:
-		return fmt.Sprintf("%s%s%s", ae.Left.String(), ae.Token.Literal, ae.Right.String())
+		if ae.Modifier != "" {
+			return fmt.Sprintf("%s%s%s%s %s", ns, ae.Left.String(), ae.Token.Literal, quoteString(ae.Right.Value), ae.Modifier)
+		}
+		return fmt.Sprintf("%s%s%s%s", ns, ae.Left.String(), ae.Token.Literal, quoteString(ae.Right.Value))
 	}
 	return ""
 }
 
 // Negation ::= NOT S* negation_arg S* ')'
-// negation_arg ::= ident | universal | HASH | class | attrib | pseudo
+// negation_arg ::= complex_selector_list
 type Negation struct {
 	*NArg
 }
@@ -186,7 +260,7 @@ func (n *Negation) String() string {
 	return sb.String()
 }
 
-// NArg ::= type_selector | universal | HASH | class | attrib | pseudo | group | sequence
+// NArg ::= type_selector | universal | HASH | class | attrib | pseudo | group | sequence | selector
 type NArg struct {
 	*Ident
 	*Universal
@@ -196,6 +270,7 @@ type NArg struct {
 	*Pseudo
 	*Group
 	*Sequence
+	*Selector
 	TypeID byte
 }
 
@@ -215,6 +290,10 @@ func (na *NArg) String() string {
 		return na.Pseudo.String()
 	case 7:
 		return na.Group.String()
+	case 8:
+		return na.Sequence.String()
+	case 9:
+		return na.Selector.String()
 	}
 	return ""
 }
@@ -268,6 +347,37 @@ func (ha *HArg) String() string {
 	return ""
 }
 
+// Is ::= ':is(' forgiving_selector_list ')'
+type Is struct {
+	Selectors []Expression
+}
+
+func (i *Is) expression() {}
+func (i *Is) String() string {
+	return fmt.Sprintf(":is(%s)", joinSelectors(i.Selectors))
+}
+
+// Where ::= ':where(' forgiving_selector_list ')'
+type Where struct {
+	Selectors []Expression
+}
+
+func (w *Where) expression() {}
+func (w *Where) String() string {
+	return fmt.Sprintf(":where(%s)", joinSelectors(w.Selectors))
+}
+
+func joinSelectors(sels []Expression) string {
+	var sb strings.Builder
+	for i, s := range sels {
+		sb.WriteString(s.String())
+		if i < len(sels)-1 {
+			sb.WriteString(", ")
+		}
+	}
+	return sb.String()
+}
+
 // Pseudo ::= ':' ':'? [ IDENT | functional_pseudo ]
 type Pseudo struct {
 	*Ident
@@ -300,28 +410,32 @@ func (fp *FunctionalPseudo) String() string {
 	return fmt.Sprintf("%s(%s)", fp.Token.Literal, fp.Arg.String())
 }
 
-// Arg ::= DIMENSION | NUMBER | STRING | IDENT
+// Arg ::= [ DIMENSION | NUMBER | STRING | IDENT ] [ S+ 'of' S+ selector_list ]?
 type Arg struct {
 	*Dimension
 	*Number
 	*Str
 	*Ident
 	TypeID byte
+	Of     Expression
 }
 
 func (a *Arg) String() string {
+	var s string
 	switch a.TypeID {
 	case 1:
-		return a.Dimension.String()
+		s = a.Dimension.String()
 	case 2:
-		return a.Number.String()
+		s = a.Number.String()
 	case 3:
-		return a.Str.String()
+		s = a.Str.String()
 	case 4:
-		return a.Ident.String()
-	default:
-		return ""
+		s = a.Ident.String()
+	}
+	if a.Of != nil {
+		s += " of " + a.Of.String()
 	}
+	return s
 }
 
 // Number ::= int
@@ -341,7 +455,7 @@ type Ident struct {
 
 func (i *Ident) expression() {}
 func (i *Ident) String() string {
-	return i.Value
+	return escapeIdent(i.Value)
 }
 
 // Str ::= string
@@ -351,7 +465,7 @@ type Str struct {
 
 func (s *Str) expression() {}
 func (s *Str) String() string {
-	return fmt.Sprintf("%q", s.Value)
+	return quoteString(s.Value)
 }
 
 // Dimension ::= an + b
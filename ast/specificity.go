@@ -0,0 +1,165 @@
+package ast
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/zzossig/carrot/token"
+)
+
+// Specificity computes the specificity of a selector following
+// https://www.w3.org/TR/selectors-4/#specificity-rules
+// a counts ids, b counts classes, attributes and pseudo-classes,
+// and c counts type selectors and pseudo-elements.
+// :is(), :not() and :has() count as their most specific argument,
+// :where() counts as nothing, and :nth-child(An+B of S) counts as
+// a pseudo-class plus the most specific selector of S.
+// A group of selectors counts as its most specific selector.
+func Specificity(expr Expression) (a, b, c int) {
+	s := specificityOf(expr)
+	return s[0], s[1], s[2]
+}
+
+// SortBySpecificity sorts selectors from the most specific to the least.
+// Selectors with the same specificity keep their order.
+func SortBySpecificity(selectors []Expression) {
+	specs := make(map[Expression]specificity, len(selectors))
+	for _, s := range selectors {
+		specs[s] = specificityOf(s)
+	}
+
+	sort.SliceStable(selectors, func(i, j int) bool {
+		return specs[selectors[j]].less(specs[selectors[i]])
+	})
+}
+
+// specificity holds the a, b and c components.
+type specificity [3]int
+
+func (s specificity) add(o specificity) specificity {
+	return specificity{s[0] + o[0], s[1] + o[1], s[2] + o[2]}
+}
+
+func (s specificity) less(o specificity) bool {
+	for i := range s {
+		if s[i] != o[i] {
+			return s[i] < o[i]
+		}
+	}
+	return false
+}
+
+// legacyPseudoElements are pseudo-elements that can be written with a single colon.
+var legacyPseudoElements = map[string]bool{
+	"before": true, "after": true, "first-line": true, "first-letter": true,
+}
+
+func specificityOf(expr Expression) specificity {
+	switch expr := expr.(type) {
+	case *Group:
+		return maxSpecificity(expr.Selectors)
+	case *Selector:
+		return specificityOf(expr.Left).add(specificityOf(expr.Right))
+	case *RSelector:
+		return specificityOf(expr.Expr)
+	case *Sequence:
+		var s specificity
+		if expr.Expression != nil {
+			s = specificityOf(expr.Expression)
+		}
+		for _, e := range expr.Exprs {
+			s = s.add(specificityOf(e))
+		}
+		return s
+	case *Hash:
+		return specificity{1, 0, 0}
+	case *Class, *Attrib:
+		return specificity{0, 1, 0}
+	case *Ident:
+		return specificity{0, 0, 1}
+	case *Negation:
+		if expr.NArg != nil {
+			return narg(expr.NArg)
+		}
+	case *Has:
+		if expr.HArg != nil {
+			return harg(expr.HArg)
+		}
+	case *Is:
+		return maxSpecificity(expr.Selectors)
+	case *Pseudo:
+		return pseudo(expr)
+	}
+
+	// *Universal, *Where and anything else
+	return specificity{}
+}
+
+func pseudo(p *Pseudo) specificity {
+	switch p.TypeID {
+	case 1:
+		if p.Token.Type == token.DCOLON || legacyPseudoElements[strings.ToLower(p.Ident.Value)] {
+			return specificity{0, 0, 1}
+		}
+	case 2:
+		if p.Token.Type == token.DCOLON {
+			return specificity{0, 0, 1}
+		}
+		if p.FunctionalPseudo.Arg != nil && p.FunctionalPseudo.Arg.Of != nil {
+			return specificity{0, 1, 0}.add(specificityOf(p.FunctionalPseudo.Arg.Of))
+		}
+	}
+	return specificity{0, 1, 0}
+}
+
+func narg(na *NArg) specificity {
+	switch na.TypeID {
+	case 1:
+		return specificityOf(na.Ident)
+	case 3:
+		return specificityOf(na.Hash)
+	case 4:
+		return specificityOf(na.Class)
+	case 5:
+		return specificityOf(na.Attrib)
+	case 6:
+		return specificityOf(na.Pseudo)
+	case 7:
+		return specificityOf(na.Group)
+	case 8:
+		return specificityOf(na.Sequence)
+	case 9:
+		return specificityOf(na.Selector)
+	}
+	return specificity{}
+}
+
+func harg(ha *HArg) specificity {
+	switch ha.TypeID {
+	case 1:
+		return specificityOf(ha.Ident)
+	case 3:
+		return specificityOf(ha.Hash)
+	case 4:
+		return specificityOf(ha.Class)
+	case 5:
+		return specificityOf(ha.Attrib)
+	case 6:
+		return specificityOf(ha.Pseudo)
+	case 7:
+		return specificityOf(ha.Group)
+	case 8:
+		return specificityOf(ha.RSelector)
+	}
+	return specificity{}
+}
+
+func maxSpecificity(sels []Expression) specificity {
+	var max specificity
+	for _, s := range sels {
+		if sp := specificityOf(s); max.less(sp) {
+			max = sp
+		}
+	}
+	return max
+}
@@ -1,19 +1,22 @@
 package carrot
 
 import (
+	"context"
 	"net/http"
+	"sync"
 
 	"github.com/zzossig/carrot/eval"
-	"github.com/zzossig/carrot/lexer"
-	"github.com/zzossig/carrot/parser"
 	"golang.org/x/net/html"
 )
 
 // CSS is a base object to evaluate css selectors.
+// Once a document is set, Eval and Select can be called from multiple goroutines.
+// A selector that fails to parse selects nothing and adds its errors to Errors,
+// without affecting other queries.
 type CSS struct {
-	selector string
-	context  *eval.Context
-	errors   []error
+	mu      sync.Mutex
+	context *eval.Context
+	errors  []error
 }
 
 // New creates new CSS object.
@@ -24,9 +27,6 @@ func New() *CSS {
 // SetDoc set document to a context.
 // input param can be url or local filepath.
 func (c *CSS) SetDoc(input string) *CSS {
-	c.context.GetBackCtx()
-	c.selector = ""
-
 	err := c.context.SetDoc(input)
 	if err != nil {
 		c.errors = append(c.errors, err)
@@ -35,11 +35,22 @@ func (c *CSS) SetDoc(input string) *CSS {
 	return c
 }
 
+// LoadOptions configures how SetDocContext loads a document.
+type LoadOptions = eval.LoadOptions
+
+// SetDocContext is another version of SetDoc.
+// Loading is canceled when ctx is done and is configured by opts, which may be nil.
+func (c *CSS) SetDocContext(ctx context.Context, input string, opts *LoadOptions) *CSS {
+	err := c.context.SetDocContext(ctx, input, opts)
+	if err != nil {
+		c.errors = append(c.errors, err)
+	}
+
+	return c
+}
+
 // SetDocR is another version of SetDoc.
 func (c *CSS) SetDocR(r *http.Response) *CSS {
-	c.context.GetBackCtx()
-	c.selector = ""
-
 	err := c.context.SetDocR(r)
 	if err != nil {
 		c.errors = append(c.errors, err)
@@ -50,17 +61,12 @@ func (c *CSS) SetDocR(r *http.Response) *CSS {
 
 // SetDocN is another version of SetDoc.
 func (c *CSS) SetDocN(n *html.Node) *CSS {
-	c.context.GetBackCtx()
-	c.selector = ""
 	c.context.SetDocN(n)
 	return c
 }
 
 // SetDocS is another version of SetDoc.
 func (c *CSS) SetDocS(s string) *CSS {
-	c.context.GetBackCtx()
-	c.selector = ""
-
 	err := c.context.SetDocS(s)
 	if err != nil {
 		c.errors = append(c.errors, err)
@@ -69,34 +75,144 @@ func (c *CSS) SetDocS(s string) *CSS {
 	return c
 }
 
+// SetEncoding forces the character encoding of documents set afterwards
+// instead of detecting it, e.g. "shift_jis" or "euc-kr".
+func (c *CSS) SetEncoding(label string) *CSS {
+	err := c.context.SetEncoding(label)
+	if err != nil {
+		c.errors = append(c.errors, err)
+	}
+	return c
+}
+
+// Order is the order a group of selectors returns nodes in.
+type Order = eval.Order
+
+// Orders of a group of selectors.
+const (
+	DocumentOrder = eval.DocumentOrder // nodes in document order, the default
+	SelectorOrder = eval.SelectorOrder // nodes matched by each selector in turn
+)
+
+// SetOrder sets the order a group of selectors like "h2, h1" returns nodes in.
+func (c *CSS) SetOrder(o Order) *CSS {
+	c.context.SetOrder(o)
+	return c
+}
+
+// SetNamespace maps a namespace prefix used in selectors to a namespace uri.
+// An empty prefix sets the default namespace. The prefixes html, svg, math,
+// xlink, xml and xmlns are declared by default; a selector using any other
+// prefix that is not set fails like a selector that does not parse.
+func (c *CSS) SetNamespace(prefix, uri string) *CSS {
+	c.context.SetNamespace(prefix, uri)
+	return c
+}
+
 // Eval evaluates a css selector
 func (c *CSS) Eval(input string) []*html.Node {
-	if len(c.errors) > 0 {
+	s, ok := c.compile(input)
+	if !ok {
 		return nil
 	}
 
-	c.selector = input
+	return c.Select(s)
+}
+
+// Find evaluates a css selector relative to root, an element of the document,
+// and returns the descendants of root it matches. See Selector.Find.
+func (c *CSS) Find(root *html.Node, input string) []*html.Node {
+	s, ok := c.compile(input)
+	if !ok {
+		return nil
+	}
 
-	l := lexer.New(input)
-	p := parser.New(l)
-	pe := p.ParseExpression()
+	return eval.Find(root, s.expr, c.context)
+}
+
+// Matches reports whether n, an element of the document, is matched by a css selector.
+// :scope matches n.
+func (c *CSS) Matches(n *html.Node, input string) bool {
+	s, ok := c.compile(input)
+	if !ok {
+		return false
+	}
 
-	if len(p.Errors()) != 0 {
-		c.errors = append(c.errors, p.Errors()...)
+	return eval.Matches(n, s.expr, c.context)
+}
+
+// Closest returns n or its nearest ancestor matched by a css selector, or nil.
+// :scope matches n.
+func (c *CSS) Closest(n *html.Node, input string) *html.Node {
+	s, ok := c.compile(input)
+	if !ok {
 		return nil
 	}
 
-	e := eval.Eval(pe, c.context)
-	c.context.GetBackCtx()
-	return e
+	return eval.Closest(n, s.expr, c.context)
+}
+
+// Trace records the evaluation of a selector by Explain.
+type Trace = eval.Trace
+
+// Explain evaluates a css selector like Eval and also returns how it was evaluated:
+// the number of nodes going in and out of each step and some of the resulting nodes.
+// Printing the Trace shows which step leaves no nodes.
+func (c *CSS) Explain(input string) ([]*html.Node, *Trace) {
+	s, ok := c.compile(input)
+	if !ok {
+		return nil, nil
+	}
+
+	return eval.Explain(s.expr, c.context)
+}
+
+// Select evaluates a compiled selector against the document.
+// A selector using a namespace prefix that is not declared by SetNamespace
+// selects nothing and adds an error to Errors.
+func (c *CSS) Select(s *Selector) []*html.Node {
+	if err := eval.CheckNamespaces(s.expr, c.context); err != nil {
+		c.addErrors(err)
+		return nil
+	}
+
+	return eval.Eval(s.expr, c.context)
+}
+
+// compile parses input and checks its namespace prefixes, recording the
+// errors if it fails. The errors only stop the query input belongs to.
+func (c *CSS) compile(input string) (*Selector, bool) {
+	s, errs := compile(input)
+	if len(errs) == 0 {
+		if err := eval.CheckNamespaces(s.expr, c.context); err != nil {
+			errs = []error{err}
+		}
+	}
+	if len(errs) != 0 {
+		c.addErrors(errs...)
+		return nil, false
+	}
+	return s, true
+}
+
+func (c *CSS) addErrors(errs ...error) {
+	c.mu.Lock()
+	c.errors = append(c.errors, errs...)
+	c.mu.Unlock()
 }
 
-// Errors returns errors field
+// Errors returns the errors of loading documents and of the selectors that
+// failed to parse. Use Compile to get the error of a single selector.
 func (c *CSS) Errors() []error {
-	return c.errors
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]error(nil), c.errors...)
 }
 
-// String returns input field
+// String returns an empty string.
+//
+// Deprecated: it used to return the last selector, which is not tracked
+// since a CSS can be queried from multiple goroutines.
 func (c *CSS) String() string {
-	return c.selector
+	return ""
 }
@@ -1,6 +1,20 @@
 package carrot
 
-import "testing"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zzossig/carrot/ast"
+	"github.com/zzossig/carrot/parser"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
 
 func TestCSS(t *testing.T) {
 	carrot := New().SetDoc("./eval/testdata/t.html")
@@ -22,4 +36,753 @@ func TestCSS(t *testing.T) {
 	if len(e3) != 2 {
 		t.Errorf("length should be 2. got=%d", len(e3))
 	}
+
+	// an invalid selector does not stop the queries after it
+	css := New().SetDocS("<p>a</p><p>b</p>")
+	if e := css.Eval("p"); len(e) != 2 {
+		t.Errorf("length should be 2. got=%d", len(e))
+	}
+	if e := css.Eval("p["); e != nil || len(css.Errors()) != 1 {
+		t.Errorf("p[ should fail. got=%v, errors=%v", e, css.Errors())
+	}
+	if e := css.Eval("p"); len(e) != 2 {
+		t.Errorf("length should be 2 after an invalid selector. got=%d", len(e))
+	}
+	if e := css.Find(css.context.Doc, "p"); len(e) != 2 {
+		t.Errorf("Find should work after an invalid selector. got=%d", len(e))
+	}
+}
+
+func TestSelector(t *testing.T) {
+	doc := New().SetDoc("./eval/testdata/t.html").context.Doc
+
+	s := MustCompile("div > p")
+	e1 := s.Select(doc)
+	if len(e1) != 6 {
+		t.Errorf("wrong number of items. got=%d, expected=6", len(e1))
+	}
+
+	if f := s.First(doc); f != e1[0] {
+		t.Errorf("First should return the first selected node")
+	}
+	if f := MustCompile("h7").First(doc); f != nil {
+		t.Errorf("First should return nil. got=%v", f)
+	}
+
+	if !s.Match(e1[1]) {
+		t.Errorf("selected node should match")
+	}
+	h1 := MustCompile("h1").First(doc)
+	if s.Match(h1) {
+		t.Errorf("h1 should not match %s", s)
+	}
+
+	carrot := New().SetDoc("./eval/testdata/t.html")
+	e2 := carrot.Select(s)
+	if len(e2) != len(e1) {
+		t.Errorf("wrong number of items. got=%d, expected=%d", len(e2), len(e1))
+	}
+
+	if _, err := Compile("div >"); err == nil {
+		t.Errorf("Compile should return an error")
+	}
+	if _, err := Compile(""); err == nil {
+		t.Errorf("Compile should return an error")
+	}
+
+	_, err := Compile("div > [href=]")
+	var pe *parser.ParseError
+	if !errors.As(err, &pe) {
+		t.Fatalf("Compile should return a *parser.ParseError, got=%T", err)
+	}
+	if pe.Offset != 12 {
+		t.Errorf("wrong offset. got=%d, expected=12", pe.Offset)
+	}
+}
+
+func TestConcurrentCSS(t *testing.T) {
+	carrot := New().SetDoc("./eval/testdata/t.html")
+	s := MustCompile("h6 ~ p")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			if e := carrot.Eval("h1["); e != nil {
+				t.Errorf("h1[ should select nothing")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if e := carrot.Eval("h1"); len(e) != 1 {
+				t.Errorf("length should be 1. got=%d", len(e))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if e := carrot.Select(s); len(e) != 4 {
+				t.Errorf("wrong number of items. got=%d, expected=4", len(e))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(carrot.Errors()) != 16 {
+		t.Errorf("wrong number of errors. got=%d, expected=16", len(carrot.Errors()))
+	}
+}
+
+func TestSetNamespace(t *testing.T) {
+	doc := `<p><svg><a xlink:href="#x"><text>x</text></a></svg><a href="#y">y</a></p>`
+
+	carrot := New().SetDocS(doc).SetNamespace("s", "http://www.w3.org/2000/svg")
+	if e := carrot.Eval("s|a[xlink|href]"); len(e) != 1 {
+		t.Errorf("length should be 1. got=%d", len(e))
+	}
+	if e := carrot.Eval("a"); len(e) != 2 {
+		t.Errorf("length should be 2. got=%d", len(e))
+	}
+	if e := carrot.SetNamespace("", "http://www.w3.org/2000/svg").Eval("a"); len(e) != 1 {
+		t.Errorf("length should be 1. got=%d", len(e))
+	}
+
+	// an undeclared prefix is an error, anywhere but in a forgiving list
+	invalid := []string{"foo|a", "a[foo|href]", "p :not(foo|a)", "p:has(> foo|a)", ":nth-child(1 of foo|a)", "svg, foo|a"}
+	for i, input := range invalid {
+		if e := carrot.Eval(input); e != nil {
+			t.Errorf("%s should select nothing. got=%d", input, len(e))
+		}
+		errs := carrot.Errors()
+		if len(errs) != i+1 || !strings.Contains(errs[i].Error(), `undeclared namespace prefix "foo"`) {
+			t.Errorf("%s should report the prefix. got=%v", input, errs)
+		}
+	}
+	if e := carrot.Find(carrot.context.Doc, "foo|a"); e != nil || len(carrot.Errors()) != len(invalid)+1 {
+		t.Errorf("Find should report the prefix")
+	}
+	if e := carrot.Select(MustCompile("foo|a")); e != nil || len(carrot.Errors()) != len(invalid)+2 {
+		t.Errorf("Select should report the prefix")
+	}
+	if e := carrot.Eval("svg :is(foo|a, text)"); len(e) != 1 || len(carrot.Errors()) != len(invalid)+2 {
+		t.Errorf(":is() should forgive the prefix. got=%d, errors=%v", len(e), carrot.Errors())
+	}
+	if e := carrot.SetNamespace("foo", "http://www.w3.org/2000/svg").Eval("foo|a"); len(e) != 1 {
+		t.Errorf("length should be 1 once foo is declared. got=%d", len(e))
+	}
+}
+
+func TestSetOrder(t *testing.T) {
+	carrot := New().SetDoc("./eval/testdata/t.html")
+	if e := carrot.Eval("h2, h1"); len(e) != 2 || e[0].Data != "h1" || e[1].Data != "h2" {
+		t.Errorf("h2, h1 should be in document order")
+	}
+	if e := carrot.SetOrder(SelectorOrder).Eval("h2, h1"); len(e) != 2 || e[0].Data != "h2" || e[1].Data != "h1" {
+		t.Errorf("h2, h1 should be in selector order")
+	}
+	if e := carrot.Select(MustCompile("h2, h1")); len(e) != 2 || e[0].Data != "h2" {
+		t.Errorf("CSS.Select should follow the order")
+	}
+	if e := MustCompile("h2, h1").Select(carrot.context.Doc); len(e) != 2 || e[0].Data != "h1" {
+		t.Errorf("Selector.Select should be in document order")
+	}
+}
+
+func TestFind(t *testing.T) {
+	carrot := New().SetDoc("./eval/testdata/t.html")
+	card := carrot.Eval("#f")[0]
+
+	if e := carrot.Find(card, "> p"); len(e) != 1 {
+		t.Errorf("length should be 1. got=%d", len(e))
+	}
+	if e := MustCompile("#d :scope p").Find(card); len(e) != 3 {
+		t.Errorf("length should be 3. got=%d", len(e))
+	}
+	if e := carrot.Find(card, "> [p"); e != nil || len(carrot.Errors()) != 1 {
+		t.Errorf("parse errors should be recorded")
+	}
+}
+
+func TestMatches(t *testing.T) {
+	carrot := New().SetDoc("./eval/testdata/t.html")
+	n := carrot.Eval("#g > .foo")[0]
+
+	tests := []struct {
+		input   string
+		matches bool
+		closest string
+	}{
+		{"#d p", true, "p"},
+		{"#d > p", false, ""},
+		{".depth", false, "div"},
+		{"body", false, "body"},
+		{":scope", true, "p"},
+		{"#g > :scope", true, "p"},
+		{":scope > span", false, ""},
+		{":not(:scope)", false, "div"},
+	}
+
+	for _, tt := range tests {
+		ok, err := Matches(n, tt.input)
+		if err != nil || ok != tt.matches {
+			t.Errorf("Matches(%q) should be %v. got=%v, err=%v", tt.input, tt.matches, ok, err)
+		}
+		if ok := carrot.Matches(n, tt.input); ok != tt.matches {
+			t.Errorf("CSS.Matches(%q) should be %v", tt.input, tt.matches)
+		}
+
+		c, err := Closest(n, tt.input)
+		if err != nil || (c == nil) != (tt.closest == "") || c != nil && c.Data != tt.closest {
+			t.Errorf("Closest(%q) should be %q. got=%v, err=%v", tt.input, tt.closest, c, err)
+		}
+		if c2 := carrot.Closest(n, tt.input); c2 != c {
+			t.Errorf("CSS.Closest(%q) should be the same as Closest", tt.input)
+		}
+	}
+
+	if _, err := Matches(n, "p["); err == nil {
+		t.Errorf("Matches should fail with an invalid selector")
+	}
+}
+
+func TestMatchesFragment(t *testing.T) {
+	body := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	frag, err := html.ParseFragment(strings.NewReader(`<div class="a"><p>x <span>y</span></p></div>`), body)
+	if err != nil || len(frag) != 1 {
+		t.Fatalf("parsing the fragment failed: %v", err)
+	}
+	div := frag[0]
+	p := div.FirstChild
+	span := p.LastChild
+
+	tests := []struct {
+		n       *html.Node
+		input   string
+		matches bool
+		closest *html.Node
+	}{
+		{div, "div.a", true, div},
+		{div, "body div", false, nil},
+		{p, "div.a > p", true, p},
+		{span, "div p span", true, span},
+		{span, ".a", false, div},
+		{span, "div", false, div},
+		{p, ":not(div) > p", false, nil},
+		{div, ":scope", true, div},
+		{span, "p > :scope", true, span},
+	}
+
+	for _, tt := range tests {
+		if ok, err := Matches(tt.n, tt.input); err != nil || ok != tt.matches {
+			t.Errorf("Matches(%s, %q) should be %v. got=%v, err=%v", tt.n.Data, tt.input, tt.matches, ok, err)
+		}
+		if c, err := Closest(tt.n, tt.input); err != nil || c != tt.closest {
+			t.Errorf("Closest(%s, %q) should be %v. got=%v, err=%v", tt.n.Data, tt.input, tt.closest, c, err)
+		}
+		if n := NewSelection(tt.n).Filter(tt.input).Len(); n == 1 != tt.matches {
+			t.Errorf("Filter(%q) on %s should agree with Matches", tt.input, tt.n.Data)
+		}
+	}
+
+	if nodes := MustCompile("div.a span").Find(div); len(nodes) != 1 || nodes[0] != span {
+		t.Errorf("Find should see the detached root. got=%v", nodes)
+	}
+	if parent := NewSelection(p, span).Parent(); parent.Len() != 2 || parent.Nodes[0] != div {
+		t.Errorf("Parent should include the detached root. got=%v", parent.Nodes)
+	}
+	if parent := NewSelection(div).Parent(); parent.Len() != 0 {
+		t.Errorf("the detached root has no parent. got=%v", parent.Nodes)
+	}
+}
+
+func TestSelection(t *testing.T) {
+	carrot := New().SetDoc("./eval/testdata/t.html")
+
+	tests := []struct {
+		sel      *Selection
+		expected int
+	}{
+		{carrot.Query("p"), 17},
+		{carrot.Query("p").Filter(".foo"), 2},
+		{carrot.Query("p").Not("[class]"), 8},
+		{carrot.Query(".depth").Children(), 9},
+		{carrot.Query(".depth > p").Parent(), 4},
+		{carrot.Query("#d p").Closest("div"), 4},
+		{carrot.Query("h1, h2").Next(), 2},
+		{carrot.Query("h2").Prev(), 1},
+		{carrot.Query(".depth").Find("> p"), 6},
+		{carrot.Query("#f, #g").Find("p"), 3},
+		{carrot.Query("p").Eq(-1), 1},
+		{carrot.Query("p").Eq(17), 0},
+		{NewSelection(carrot.Eval("#f")...).Find("#e > div > p"), 1},
+	}
+
+	for i, tt := range tests {
+		if tt.sel.Len() != tt.expected {
+			t.Errorf("tests[%d]: wrong number of items. got=%d, expected=%d", i, tt.sel.Len(), tt.expected)
+		}
+		nodes := tt.sel.Nodes
+		for j := 1; j < len(nodes); j++ {
+			if nodes[j-1] == nodes[j] || !MustCompile("*").Match(nodes[j]) {
+				t.Errorf("tests[%d]: wrong items", i)
+			}
+		}
+	}
+
+	if text := carrot.Query("p.bar").Text(); text != "Lorem ipsum example dolor sit amet" {
+		t.Errorf("wrong text. got=%q", text)
+	}
+	if v, ok := carrot.Query("span[hello]").Attr("hello"); !ok || v != "Cleveland" {
+		t.Errorf("wrong attribute. got=%q", v)
+	}
+	if v := carrot.Query("h1").AttrOr("id", "none"); v != "none" {
+		t.Errorf("wrong attribute. got=%q", v)
+	}
+
+	// the node helpers read a single node like the Selection does
+	n := carrot.Eval("span[hello]")[0]
+	if v, ok := Attr(n, "hello"); !ok || v != "Cleveland" {
+		t.Errorf("wrong attribute. got=%q", v)
+	}
+	if _, ok := Attr(n, "id"); ok {
+		t.Errorf("span[hello] has no id")
+	}
+	if Text(n) != NewSelection(n).Text() {
+		t.Errorf("Text should agree with Selection.Text. got=%q", Text(n))
+	}
+	p := carrot.Eval("p.bar")[0]
+	inner, err := InnerHTML(p)
+	if err != nil || inner != `Lorem <span class="example">ipsum example</span> dolor sit amet` {
+		t.Errorf("wrong inner html. got=%q, err=%v", inner, err)
+	}
+	if h, err := carrot.Query("p.bar").HTML(); err != nil || h != inner {
+		t.Errorf("Selection.HTML should agree with InnerHTML. got=%q, err=%v", h, err)
+	}
+	if h, err := carrot.Query("table").HTML(); err != nil || h != "" {
+		t.Errorf("an empty Selection has no html. got=%q, err=%v", h, err)
+	}
+	if outer, err := OuterHTML(p); err != nil || outer != `<p class="bar">`+inner+"</p>" {
+		t.Errorf("wrong outer html. got=%q, err=%v", outer, err)
+	}
+	if !carrot.Query("#g").Children().Is(".foo") {
+		t.Errorf("children of #g should include .foo")
+	}
+
+	var ids []string
+	carrot.Query(".depth").Each(func(i int, s *Selection) {
+		ids = append(ids, s.AttrOr("id", ""))
+	})
+	if strings.Join(ids, "") != "defg" {
+		t.Errorf("wrong ids. got=%v", ids)
+	}
+	classes := carrot.Query("#g > p").Map(func(i int, s *Selection) string {
+		return s.AttrOr("class", "")
+	})
+	if strings.Join(classes, " ") != "foobar foo" {
+		t.Errorf("wrong classes. got=%v", classes)
+	}
+
+	if carrot.Query("p").Filter("p[").Len() != 0 || len(carrot.Errors()) != 1 {
+		t.Errorf("parse errors should be recorded")
+	}
+
+	// a parse error does not affect the queries after it
+	sel := carrot.Query(".depth")
+	if sel.Filter(":oops(").Len() != 0 || len(carrot.Errors()) != 2 {
+		t.Errorf("parse errors should be recorded")
+	}
+	if n := sel.Find("> p").Len(); n != 6 {
+		t.Errorf("Find after a parse error. got=%d, expected=6", n)
+	}
+	if n := sel.Find("p").Closest("#g").Len(); n != 1 {
+		t.Errorf("Closest after a parse error. got=%d, expected=1", n)
+	}
+	if n := sel.Filter("#d, #e").Len(); n != 2 {
+		t.Errorf("Filter after a parse error. got=%d, expected=2", n)
+	}
+}
+
+type price struct {
+	Currency string
+	Amount   float64
+}
+
+func (p *price) UnmarshalHTML(s *Selection) error {
+	text := []rune(strings.TrimSpace(s.Text()))
+	if len(text) < 2 {
+		return fmt.Errorf("invalid price %q", string(text))
+	}
+	p.Currency = string(text[0])
+	_, err := fmt.Sscan(string(text[1:]), &p.Amount)
+	return err
+}
+
+type article struct {
+	Title   string    `carrot:"h1.title"`
+	Next    string    `carrot:"a.next,attr=href"`
+	Missing string    `carrot:"a.next,attr=title"`
+	Body    string    `carrot:".body,html"`
+	Tags    []string  `carrot:"ul > li,text"`
+	Views   int       `carrot:".views"`
+	Rating  float32   `carrot:".rating,attr=data-value"`
+	Draft   bool      `carrot:"[data-draft],attr=data-draft"`
+	Date    time.Time `carrot:"time,attr=datetime"`
+	Day     time.Time `carrot:"time,layout=Jan 2, 2006"`
+	Author  *author   `carrot:".author"`
+	Editor  *author   `carrot:".editor"`
+	Items   []item    `carrot:".items > li"`
+	Total   price     `carrot:".total"`
+	Heading string    `carrot:"h2, h1"`
+	Ignored string    `carrot:"-"`
+	meta
+}
+
+type author struct {
+	Name string `carrot:"> span"`
+	URL  string `carrot:",attr=data-url"`
+}
+
+type item struct {
+	Name  string  `carrot:".name"`
+	Price price   `carrot:".price"`
+	Count *uint16 `carrot:".count"`
+}
+
+type meta struct {
+	Lang string `carrot:"html,attr=lang"`
+}
+
+func TestUnmarshal(t *testing.T) {
+	doc := `<html lang="en"><body><article data-draft="true">
+		<h1 class="title"> Carrots </h1>
+		<a class="next" href="/2">next</a>
+		<div class="body"><b>Orange</b> roots</div>
+		<ul><li>food</li><li>plant</li></ul>
+		<span class="views">1024</span>
+		<span class="rating" data-value="4.5">★★★★½</span>
+		<time datetime="2021-03-04T05:06:07Z">Mar 4, 2021</time>
+		<p class="author" data-url="/ann"><span>Ann</span></p>
+		<ol class="items">
+			<li><span class="name">seed</span> <span class="price">$1.5</span> <span class="count">3</span></li>
+			<li><span class="name">soil</span> <span class="price">€20</span></li>
+		</ol>
+		<p class="total">$21.5</p>
+	</article></body></html>`
+
+	var a article
+	a.Ignored = "kept"
+	if err := Unmarshal(New().SetDocS(doc).context.Doc, &a); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if a.Title != "Carrots" || a.Next != "/2" || a.Missing != "" || a.Body != "<b>Orange</b> roots" {
+		t.Errorf("wrong strings: %q %q %q %q", a.Title, a.Next, a.Missing, a.Body)
+	}
+	if strings.Join(a.Tags, " ") != "food plant" {
+		t.Errorf("wrong tags: %v", a.Tags)
+	}
+	if a.Views != 1024 || a.Rating != 4.5 || !a.Draft {
+		t.Errorf("wrong numbers: %d %v %v", a.Views, a.Rating, a.Draft)
+	}
+	if !a.Date.Equal(time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)) || !a.Day.Equal(time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("wrong times: %v %v", a.Date, a.Day)
+	}
+	if a.Author == nil || a.Author.Name != "Ann" || a.Author.URL != "/ann" || a.Editor != nil {
+		t.Errorf("wrong authors: %+v %+v", a.Author, a.Editor)
+	}
+	if len(a.Items) != 2 || a.Items[0].Name != "seed" || a.Items[1].Price != (price{"€", 20}) ||
+		a.Items[0].Count == nil || *a.Items[0].Count != 3 || a.Items[1].Count != nil {
+		t.Errorf("wrong items: %+v", a.Items)
+	}
+	if a.Total != (price{"$", 21.5}) || a.Heading != "Carrots" || a.Ignored != "kept" || a.Lang != "en" {
+		t.Errorf("wrong fields: %+v %q %q %q", a.Total, a.Heading, a.Ignored, a.Lang)
+	}
+
+	// the second time, the fields of the types come from the cache
+	b := article{Ignored: "kept"}
+	if err := Unmarshal(New().SetDocS(doc).context.Doc, &b); err != nil || !reflect.DeepEqual(a, b) {
+		t.Errorf("unmarshaling again should give the same result. got=%+v, err=%v", b, err)
+	}
+
+	var items []item
+	if err := New().SetDocS(doc).Query(".items > li").Unmarshal(&items); err != nil || len(items) != 2 || items[1].Name != "soil" {
+		t.Errorf("wrong items: %+v, err=%v", items, err)
+	}
+
+	errs := []struct {
+		v        interface{}
+		expected string
+	}{
+		{a, "non-nil pointer"},
+		{&struct {
+			N int `carrot:"h1"`
+		}{}, `"Carrots" into N of type int`},
+		{&struct {
+			N int `carrot:"h1["`
+		}{}, "selector of N"},
+		{&struct {
+			Items []struct {
+				P price `carrot:".count"`
+			} `carrot:".items > li"`
+		}{}, "Items[0].P: invalid price"},
+		{&struct {
+			M map[string]string `carrot:"h1"`
+		}{}, "unsupported type"},
+	}
+	for _, tt := range errs {
+		err := Unmarshal(New().SetDocS(doc).context.Doc, tt.v)
+		if err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("error should contain %q. got=%v", tt.expected, err)
+		}
+	}
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	var sb strings.Builder
+	sb.WriteString(`<ol class="items">`)
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&sb, `<li><span class="name">item %d</span> <span class="price">$%d</span> <span class="count">%d</span></li>`, i, i, i)
+	}
+	sb.WriteString(`</ol>`)
+	doc := New().SetDocS(sb.String()).context.Doc
+
+	var v struct {
+		Items []item `carrot:".items > li"`
+	}
+	for i := 0; i < b.N; i++ {
+		if err := Unmarshal(doc, &v); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestExtract(t *testing.T) {
+	schema, err := ParseSchema([]byte(`{"fields": [
+		{"name": "title", "selector": "h1", "required": true, "transforms": ["upper"]},
+		{"name": "lang", "selector": ":root", "attr": "lang"},
+		{"name": "tags", "selector": ".tags > li", "multiple": true},
+		{"name": "none", "selector": "table"},
+		{"name": "empty", "selector": "table", "multiple": true},
+		{"name": "items", "selector": ".item", "multiple": true, "fields": [
+			{"name": "name", "selector": ".name", "transforms": ["collapse"]},
+			{"name": "id", "attr": "data-id", "transforms": ["int"]},
+			{"name": "url", "selector": "a", "attr": "href"},
+			{"name": "price", "selector": ".price", "transforms": ["regexp:([\\d.]+)", "float"]},
+			{"name": "body", "selector": "a", "html": true}
+		]}
+	]}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	doc := New().SetDocS(`<html lang="en"><h1>Shop</h1>
+		<ul class="tags"><li>a</li><li>b</li></ul>
+		<div class="item" data-id="1"><span class="name">big
+			seed</span><a href="/1"><b>buy</b></a><span class="price">$1.50</span></div>
+		<div class="item" data-id="2"><span class="name">soil</span></div>
+	</html>`).context.Doc
+
+	m, err := Extract(doc, schema)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if schema.compiled == nil {
+		t.Errorf("ParseSchema should keep the compiled fields")
+	}
+
+	got, _ := json.Marshal(m)
+	expected := `{"empty":[],"items":[{"body":"\u003cb\u003ebuy\u003c/b\u003e","id":1,"name":"big seed","price":1.5,"url":"/1"},` +
+		`{"body":null,"id":2,"name":"soil","price":null,"url":null}],"lang":"en","none":null,"tags":["a","b"],"title":"SHOP"}`
+	if string(got) != expected {
+		t.Errorf("wrong result.\ngot=     %s\nexpected=%s", got, expected)
+	}
+
+	errs := []struct {
+		schema   string
+		expected string
+	}{
+		{`{"fields": [{"name": "a", "fields": [{"name": "b", "selector": "p > [x"}]}]}`, `schema field "a.b" (p > [x): parsing error at 1:7`},
+		{`{"fields": [{"name": "a", "selector": "p", "transforms": ["int", "trim"]}]}`, "has to be the last one"},
+		{`{"fields": [{"name": "a", "selector": "p", "transforms": ["title"]}]}`, `unknown transform "title"`},
+		{`{"fields": [{"name": "a"}, {"name": "a"}]}`, "duplicate field name"},
+		{`{"fields": [{"selector": "p"}]}`, "field 0 has no name"},
+		{`{"fields": [{"name": "a", "selectr": "p"}]}`, "unknown field"},
+	}
+	for _, tt := range errs {
+		_, err := ParseSchema([]byte(tt.schema))
+		if err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("error should contain %q. got=%v", tt.expected, err)
+		}
+	}
+
+	_, err = ParseSchema([]byte(errs[0].schema))
+	var pe *parser.ParseError
+	if !errors.As(err, &pe) {
+		t.Errorf("error should wrap a *parser.ParseError. got=%T", err)
+	}
+
+	_, err = Extract(doc, &Schema{Fields: []Field{{Name: "t", Selector: "table", Required: true}}})
+	var se *SchemaError
+	if !errors.As(err, &se) || se.Path != "t" {
+		t.Errorf("error should be a *SchemaError. got=%v", err)
+	}
+	_, err = Extract(doc, &Schema{Fields: []Field{{Name: "n", Selector: "h1", Transforms: []string{"int"}}}})
+	if err == nil || !strings.Contains(err.Error(), `schema field "n" (h1)`) {
+		t.Errorf("conversion error should name the field. got=%v", err)
+	}
+
+	if _, err := Extract(doc, nil); err == nil {
+		t.Errorf("Extract should fail without a schema")
+	}
+
+	hand := &Schema{Fields: []Field{{Name: "title", Selector: "h1"}}}
+	if err := hand.Validate(); err != nil || hand.compiled == nil {
+		t.Errorf("Validate should keep the compiled fields. err=%v", err)
+	}
+	if m, err := Extract(doc, hand); err != nil || m["title"] != "Shop" {
+		t.Errorf("wrong result: %v, err=%v", m, err)
+	}
+
+	// fields changed after Validate are compiled again
+	hand.Fields[0].Selector = ".tags > li"
+	hand.Fields = append(hand.Fields, Field{Name: "lang", Selector: ":root", Attr: "lang", Transforms: []string{"upper"}})
+	if m, err := Extract(doc, hand); err != nil || m["title"] != "a" || m["lang"] != "EN" {
+		t.Errorf("Extract should use the changed fields: %v, err=%v", m, err)
+	}
+	schema.Fields[5].Fields[0].Transforms[0] = "upper"
+	if m, err := Extract(doc, schema); err != nil || m["items"].([]interface{})[1].(map[string]interface{})["name"] != "SOIL" {
+		t.Errorf("Extract should use the changed nested fields: %v, err=%v", m, err)
+	}
+
+	yml, err := ParseSchemaYAML([]byte(`
+fields:
+  - name: title
+    selector: h1
+    required: true
+    transforms: [lower]
+  - name: items
+    selector: .item
+    multiple: true
+    fields:
+      - {name: id, attr: data-id, transforms: [int]}
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m, err = Extract(doc, yml)
+	if got, _ = json.Marshal(m); err != nil || string(got) != `{"items":[{"id":1},{"id":2}],"title":"shop"}` {
+		t.Errorf("wrong result from the YAML schema: %s, err=%v", got, err)
+	}
+
+	yerrs := []struct {
+		schema   string
+		expected string
+	}{
+		{"fields:\n  - name: a\n    selector: p > [x\n", `schema field "a" (p > [x)`},
+		{"fields:\n  - name: a\n    selectr: p\n", "unknown field"},
+		{"fields:\n  - name: a\n    multiple: yes please\n", "cannot unmarshal"},
+		{"fields: [", "parsing schema: yaml"},
+	}
+	for _, tt := range yerrs {
+		_, err := ParseSchemaYAML([]byte(tt.schema))
+		if err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("error should contain %q. got=%v", tt.expected, err)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	carrot := New().SetDoc("./eval/testdata/t.html")
+
+	nodes, tr := carrot.Explain("#d > p")
+	if len(nodes) != 2 || tr == nil || tr.Out != 2 || len(tr.Children) != 3 {
+		t.Errorf("wrong explanation: %v", tr)
+	}
+	if nodes, tr := carrot.Explain("#d >"); nodes != nil || tr != nil {
+		t.Errorf("Explain should fail with an invalid selector")
+	}
+}
+
+func TestSpecificity(t *testing.T) {
+	tests := []struct {
+		input   string
+		a, b, c int
+	}{
+		{"*", 0, 0, 0},
+		{"li", 0, 0, 1},
+		{"ns|li", 0, 0, 1},
+		{"ul li", 0, 0, 2},
+		{"ul ol+li", 0, 0, 3},
+		{"h1 + *[rel=up]", 0, 1, 1},
+		{"ul ol li.red", 0, 1, 3},
+		{"li.red.level", 0, 2, 1},
+		{"#x34y", 1, 0, 0},
+		{"#s12:not(FOO)", 1, 0, 1},
+		{".foo :is(.bar, #baz)", 1, 1, 0},
+		{":not(em, strong#foo)", 1, 0, 1},
+		{":where(#a, .b) p", 0, 0, 1},
+		{"p:has(> a.x, img)", 0, 1, 2},
+		{"p::before", 0, 0, 2},
+		{"p:before", 0, 0, 2},
+		{"a:hover", 0, 1, 1},
+		{":nth-child(2n+1 of li.important)", 0, 2, 1},
+		{":nth-last-child(2)", 0, 1, 0},
+		{"> p", 0, 0, 1},
+		{"li, #a, .b", 1, 0, 0},
+	}
+
+	for _, tt := range tests {
+		a, b, c := MustCompile(tt.input).Specificity()
+		if a != tt.a || b != tt.b || c != tt.c {
+			t.Errorf("specificity of %q should be (%d,%d,%d). got=(%d,%d,%d)", tt.input, tt.a, tt.b, tt.c, a, b, c)
+		}
+	}
+}
+
+func TestSortBySpecificity(t *testing.T) {
+	var sels []*Selector
+	for _, s := range []string{"li", "#a", "ul li", ".b", "p", "#a.b"} {
+		sels = append(sels, MustCompile(s))
+	}
+
+	SortBySpecificity(sels)
+	var got []string
+	for _, s := range sels {
+		got = append(got, s.String())
+	}
+	if expected := "#a.b, #a, .b, ul li, li, p"; strings.Join(got, ", ") != expected {
+		t.Errorf("sorted selectors should be %q. got=%q", expected, strings.Join(got, ", "))
+	}
+
+	g := MustCompile("li, #a, ul li, .b").Expr().(*ast.Group)
+	ast.SortBySpecificity(g.Selectors)
+	if expected := "#a, .b, ul li, li"; g.String() != expected {
+		t.Errorf("sorted group should be %q. got=%q", expected, g.String())
+	}
+}
+
+func TestMustCompile(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("MustCompile should panic")
+		}
+	}()
+	MustCompile("[")
+}
+
+func BenchmarkCSSEval(b *testing.B) {
+	carrot := New().SetDoc("./eval/testdata/t.html")
+	for i := 0; i < b.N; i++ {
+		carrot.Eval("body > div p:nth-child(2n+1)")
+	}
+}
+
+func BenchmarkSelect(b *testing.B) {
+	carrot := New().SetDoc("./eval/testdata/t.html")
+	s := MustCompile("body > div p:nth-child(2n+1)")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		carrot.Select(s)
+	}
 }
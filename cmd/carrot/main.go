@@ -0,0 +1,293 @@
+// Command carrot prints the elements of html documents matched by css selectors.
+//
+// Usage:
+//
+//	carrot [flags] selector [file|url|- ...]
+//	carrot [flags] -e selector [-e selector ...] [file|url|- ...]
+//
+// Documents are read from files, http(s) urls, or stdin if there are none or
+// the input is "-". Matches are printed as outer html, one per line, unless
+// one of -text, -html, -attr, -json or -count is given. Flags can follow the
+// selector, so it fits in pipelines:
+//
+//	curl -s https://example.com/downloads | carrot 'a.download' -attr href
+//
+// The exit status is 0 if any element is matched, 1 if none is, and 2 on errors.
+//
+// carrot repl loads a document once and reads selectors interactively,
+// printing the tree path of each match. !ast prints how a selector is parsed,
+// and !history and !<n> recall earlier selectors:
+//
+//	carrot repl [-limit n] [-history file] file|url
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zzossig/carrot"
+	"github.com/zzossig/carrot/parser"
+	"golang.org/x/net/html"
+)
+
+// listFlag is a flag that can be given more than once.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// options are the parsed command-line flags.
+type options struct {
+	selectors listFlag
+	attr      string
+	text      bool
+	html      bool
+	json      bool
+	count     bool
+	null      bool
+	timeout   time.Duration
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) > 0 && args[0] == "repl" {
+		return runREPL(args[1:], stdin, stdout, stderr)
+	}
+
+	var opts options
+	fs := flag.NewFlagSet("carrot", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Var(&opts.selectors, "e", "`selector` to match, can be repeated")
+	fs.StringVar(&opts.attr, "attr", "", "print the value of the attribute `name`")
+	fs.BoolVar(&opts.text, "text", false, "print the text")
+	fs.BoolVar(&opts.html, "html", false, "print the inner html")
+	fs.BoolVar(&opts.json, "json", false, "print a json array")
+	fs.BoolVar(&opts.count, "count", false, "print the number of matches of each selector")
+	fs.BoolVar(&opts.null, "0", false, "separate the output with NUL instead of newline")
+	fs.DurationVar(&opts.timeout, "timeout", 30*time.Second, "time limit of loading a url")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: carrot [flags] selector [file|url|- ...]")
+		fmt.Fprintln(stderr, "       carrot [flags] -e selector [-e selector ...] [file|url|- ...]")
+		fmt.Fprintln(stderr, "       carrot repl [flags] file|url")
+		fs.PrintDefaults()
+	}
+
+	inputs, err := parseArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(opts.selectors) == 0 {
+		if len(inputs) == 0 {
+			fs.Usage()
+			return 2
+		}
+		opts.selectors = listFlag{inputs[0]}
+		inputs = inputs[1:]
+	}
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+
+	sels := make([]*carrot.Selector, len(opts.selectors))
+	for i, sel := range opts.selectors {
+		s, err := carrot.Compile(sel)
+		if err != nil {
+			var pe *parser.ParseError
+			if errors.As(err, &pe) {
+				fmt.Fprintf(stderr, "carrot: %v\n%s\n", pe, pe.Diagram())
+			} else {
+				fmt.Fprintf(stderr, "carrot: %v\n", err)
+			}
+			return 2
+		}
+		sels[i] = s
+	}
+
+	// matches holds the nodes of each selector from all the inputs
+	matches := make([][]*html.Node, len(sels))
+	for _, input := range inputs {
+		css, err := load(input, stdin, opts.timeout)
+		if err != nil {
+			fmt.Fprintf(stderr, "carrot: %v\n", err)
+			return 2
+		}
+		for i, s := range sels {
+			matches[i] = append(matches[i], css.Select(s)...)
+		}
+	}
+
+	w := &output{w: stdout, sep: "\n"}
+	if opts.null {
+		w.sep = "\x00"
+	}
+
+	found := false
+	for _, nodes := range matches {
+		found = found || len(nodes) > 0
+	}
+
+	switch {
+	case opts.count:
+		for _, nodes := range matches {
+			w.print(strconv.Itoa(len(nodes)))
+		}
+	case opts.json:
+		var vs []interface{}
+		for i, nodes := range matches {
+			for _, n := range nodes {
+				if v, ok := jsonValue(n, opts.selectors[i], &opts); ok {
+					vs = append(vs, v)
+				}
+			}
+		}
+		if vs == nil {
+			vs = []interface{}{}
+		}
+		var sb strings.Builder
+		enc := json.NewEncoder(&sb)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(vs); err != nil {
+			fmt.Fprintf(stderr, "carrot: %v\n", err)
+			return 2
+		}
+		w.print(strings.TrimSuffix(sb.String(), "\n"))
+	default:
+		for _, nodes := range matches {
+			for _, n := range nodes {
+				if s, ok := value(n, &opts); ok {
+					w.print(s)
+				}
+			}
+		}
+	}
+
+	if w.err != nil {
+		fmt.Fprintf(stderr, "carrot: %v\n", w.err)
+		return 2
+	}
+	if !found {
+		return 1
+	}
+	return 0
+}
+
+// parseArgs parses the flags in args, which can come before and after the
+// positional arguments, and returns the positional arguments.
+// Everything after "--" is positional.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var pos []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+
+		rest := fs.Args()
+		if n := len(args) - len(rest); n > 0 && args[n-1] == "--" {
+			return append(pos, rest...), nil
+		}
+		if len(rest) == 0 {
+			return pos, nil
+		}
+		pos = append(pos, rest[0])
+		args = rest[1:]
+	}
+}
+
+// load loads a document from a file, an url or stdin if input is "-".
+func load(input string, stdin io.Reader, timeout time.Duration) (*carrot.CSS, error) {
+	var css *carrot.CSS
+	if input == "-" {
+		data, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			return nil, fmt.Errorf("reading stdin: %w", err)
+		}
+		css = carrot.New().SetDocS(string(data))
+	} else {
+		css = carrot.New().SetDocContext(context.Background(), input, &carrot.LoadOptions{
+			UserAgent: "carrot",
+			Timeout:   timeout,
+		})
+	}
+
+	if errs := css.Errors(); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return css, nil
+}
+
+// value returns the text, inner html, attribute or outer html of n chosen by opts.
+// It returns false if n does not have the attribute.
+func value(n *html.Node, opts *options) (string, bool) {
+	switch {
+	case opts.attr != "":
+		return carrot.Attr(n, opts.attr)
+	case opts.text:
+		return strings.TrimSpace(carrot.Text(n)), true
+	case opts.html:
+		s, err := carrot.InnerHTML(n)
+		return s, err == nil
+	default:
+		s, err := carrot.OuterHTML(n)
+		return s, err == nil
+	}
+}
+
+// jsonValue returns a string if opts chooses a part of n, or an object describing n.
+func jsonValue(n *html.Node, sel string, opts *options) (interface{}, bool) {
+	if opts.attr != "" || opts.text || opts.html {
+		return value(n, opts)
+	}
+
+	attrs := make(map[string]string, len(n.Attr))
+	for _, a := range n.Attr {
+		key := a.Key
+		if a.Namespace != "" {
+			key = a.Namespace + ":" + a.Key
+		}
+		attrs[key] = a.Val
+	}
+
+	outer, err := carrot.OuterHTML(n)
+	if err != nil {
+		return nil, false
+	}
+	return map[string]interface{}{
+		"selector": sel,
+		"tag":      n.Data,
+		"attrs":    attrs,
+		"text":     strings.TrimSpace(carrot.Text(n)),
+		"html":     outer,
+	}, true
+}
+
+// output writes values followed by a separator and keeps the first error.
+type output struct {
+	w   io.Writer
+	sep string
+	err error
+}
+
+func (o *output) print(s string) {
+	if o.err == nil {
+		_, o.err = io.WriteString(o.w, s+o.sep)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	doc := `<ul><li><a class="download" href="/a.zip">A</a></li><li><a class="download" href="/b.zip">B <b>zip</b></a></li></ul>`
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<p class="download" href="/c.zip">C</p>`)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		args     []string
+		expected string
+		status   int
+	}{
+		{[]string{"a.download", "-attr", "href"}, "/a.zip\n/b.zip\n", 0},
+		{[]string{"-attr", "href", "a.download", "-"}, "/a.zip\n/b.zip\n", 0},
+		{[]string{"li:last-child > a"}, `<a class="download" href="/b.zip">B <b>zip</b></a>` + "\n", 0},
+		{[]string{"li:last-child > a", "-html"}, "B <b>zip</b>\n", 0},
+		{[]string{"a", "-text", "-0"}, "A\x00B zip\x00", 0},
+		{[]string{"-e", "a", "-e", "li", "-e", "p", "-count"}, "2\n2\n0\n", 0},
+		{[]string{"p", "-count"}, "0\n", 1},
+		{[]string{"li:first-child a", "-json"}, `[
+  {
+    "attrs": {
+      "class": "download",
+      "href": "/a.zip"
+    },
+    "html": "<a class=\"download\" href=\"/a.zip\">A</a>",
+    "selector": "li:first-child a",
+    "tag": "a",
+    "text": "A"
+  }
+]
+`, 0},
+		{[]string{"a", "-json", "-attr", "href"}, "[\n  \"/a.zip\",\n  \"/b.zip\"\n]\n", 0},
+		{[]string{"table", "-json"}, "[]\n", 1},
+		{[]string{".download", "-attr", "href", "-", ts.URL}, "/a.zip\n/b.zip\n/c.zip\n", 0},
+		{[]string{"--", "-x"}, "", 1},
+		{[]string{"a >"}, "", 2},
+		{[]string{"a", "./testdata/missing.html"}, "", 2},
+		{[]string{}, "", 2},
+	}
+
+	for _, tt := range tests {
+		var stdout, stderr bytes.Buffer
+		status := run(tt.args, strings.NewReader(doc), &stdout, &stderr)
+		if status != tt.status {
+			t.Errorf("%q: wrong status. got=%d, expected=%d, stderr=%q", tt.args, status, tt.status, stderr.String())
+		}
+		if stdout.String() != tt.expected {
+			t.Errorf("%q: wrong output.\ngot=%q\nexpected=%q", tt.args, stdout.String(), tt.expected)
+		}
+	}
+}
+
+func TestREPL(t *testing.T) {
+	dir := t.TempDir()
+	page := filepath.Join(dir, "page.html")
+	hist := filepath.Join(dir, "history")
+	doc := `<div id="main"><p>a</p><p class="x">b</p></div><ul><li>c</li></ul>`
+	if err := os.WriteFile(page, []byte(doc), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(hist, []byte("li\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	input := strings.Join([]string{
+		"p.x",
+		"!ast div > p",
+		"!explain div > p",
+		"div >",
+		"!1",
+		"!9",
+		"!history",
+		"!quit",
+		"p",
+	}, "\n")
+
+	var stdout, stderr bytes.Buffer
+	status := run([]string{"repl", "-history", hist, page}, strings.NewReader(input), &stdout, &stderr)
+	if status != 0 {
+		t.Fatalf("wrong status. got=%d, stderr=%q", status, stderr.String())
+	}
+
+	expected := []string{
+		"[1] html > body > div#main > p:nth-of-type(2)\n    <p class=\"x\">b</p>\n1 match\n",
+		`Selector "div > p"
+  Left: Sequence "div"
+    Expression: Ident "div"
+  Right: Sequence "p"
+    Expression: Ident "p"
+`,
+		"div >\n     ^ unexpected end of input",
+		"li\n[1] html > body > ul > li\n",
+		"no history entry 9",
+		"  child combinator 1 -> 2 [p, p.x]\n",
+		"   1  li\n   2  p.x\n   3  !ast div > p\n   4  !explain div > p\n   5  div >\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(stdout.String(), e) {
+			t.Errorf("output should contain %q. got=%q", e, stdout.String())
+		}
+	}
+	if strings.Contains(stdout.String(), "2 matches") {
+		t.Errorf("input after !quit should not run")
+	}
+
+	data, err := os.ReadFile(hist)
+	if err != nil || string(data) != "li\np.x\n!ast div > p\n!explain div > p\ndiv >\nli\n" {
+		t.Errorf("wrong history file. got=%q, err=%v", data, err)
+	}
+}
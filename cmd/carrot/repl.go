@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/zzossig/carrot"
+	"github.com/zzossig/carrot/ast"
+	"github.com/zzossig/carrot/parser"
+	"github.com/zzossig/carrot/token"
+	"golang.org/x/net/html"
+)
+
+const replHelp = `Type a selector to see its matches. Commands:
+  !ast <selector>      print the parsed selector
+  !explain <selector>  print the number of nodes in and out of each step
+  !history             list the history
+  !<n>                 run the n-th entry of the history again
+  !help                print this help
+  !quit                quit, like ctrl-d
+`
+
+// repl is an interactive session on a loaded document.
+type repl struct {
+	css     *carrot.CSS
+	out     io.Writer
+	color   bool
+	limit   int
+	history []string
+	histw   io.Writer // history file, if any
+}
+
+// runREPL runs `carrot repl [flags] file|url`.
+func runREPL(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("carrot repl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	limit := fs.Int("limit", 20, "maximum number of matches to print")
+	histFile := fs.String("history", defaultHistoryFile(), "history `file`, none if empty")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: carrot repl [flags] file|url")
+		fs.PrintDefaults()
+	}
+
+	inputs, err := parseArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(inputs) != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	css := carrot.New().SetDoc(inputs[0])
+	if errs := css.Errors(); len(errs) > 0 {
+		fmt.Fprintf(stderr, "carrot: %v\n", errs[0])
+		return 2
+	}
+
+	r := &repl{css: css, out: stdout, color: isTerminal(stdout), limit: *limit}
+	if *histFile != "" {
+		if data, err := os.ReadFile(*histFile); err == nil {
+			r.history = strings.FieldsFunc(string(data), func(r rune) bool { return r == '\n' })
+		}
+		f, err := os.OpenFile(*histFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			fmt.Fprintf(stderr, "carrot: %v\n", err)
+		} else {
+			defer f.Close()
+			r.histw = f
+		}
+	}
+
+	fmt.Fprintf(stdout, "loaded %s, type !help for help\n", inputs[0])
+	sc := bufio.NewScanner(stdin)
+	for {
+		fmt.Fprint(stdout, "carrot> ")
+		if !sc.Scan() {
+			fmt.Fprintln(stdout)
+			break
+		}
+		if !r.exec(strings.TrimSpace(sc.Text())) {
+			break
+		}
+	}
+
+	if err := sc.Err(); err != nil {
+		fmt.Fprintf(stderr, "carrot: %v\n", err)
+		return 2
+	}
+	return 0
+}
+
+// exec runs a line of input. It returns false to quit.
+func (r *repl) exec(line string) bool {
+	switch {
+	case line == "":
+		return true
+	case line == "!quit":
+		return false
+	case line == "!help":
+		fmt.Fprint(r.out, replHelp)
+		return true
+	case line == "!history":
+		for i, h := range r.history {
+			fmt.Fprintf(r.out, "%4d  %s\n", i+1, h)
+		}
+		return true
+	}
+
+	if i, err := strconv.Atoi(strings.TrimPrefix(line, "!")); err == nil && line[0] == '!' {
+		if i < 1 || i > len(r.history) {
+			fmt.Fprintf(r.out, "no history entry %d\n", i)
+			return true
+		}
+		line = r.history[i-1]
+		fmt.Fprintln(r.out, line)
+	}
+	r.remember(line)
+
+	switch {
+	case strings.HasPrefix(line, "!ast "):
+		if s := r.compile(strings.TrimPrefix(line, "!ast ")); s != nil {
+			printAST(r.out, "", s.Expr(), "")
+		}
+	case strings.HasPrefix(line, "!explain "):
+		if s := r.compile(strings.TrimPrefix(line, "!explain ")); s != nil {
+			_, tr := r.css.Explain(s.String())
+			fmt.Fprint(r.out, tr)
+		}
+	case strings.HasPrefix(line, "!"):
+		fmt.Fprintf(r.out, "unknown command %s, type !help for help\n", line)
+	default:
+		if s := r.compile(line); s != nil {
+			r.printMatches(r.css.Select(s))
+		}
+	}
+	return true
+}
+
+// remember adds line to the history.
+func (r *repl) remember(line string) {
+	if n := len(r.history); n > 0 && r.history[n-1] == line {
+		return
+	}
+	r.history = append(r.history, line)
+	if r.histw != nil {
+		fmt.Fprintln(r.histw, line)
+	}
+}
+
+func (r *repl) compile(sel string) *carrot.Selector {
+	s, err := carrot.Compile(sel)
+	if err != nil {
+		var pe *parser.ParseError
+		if errors.As(err, &pe) {
+			fmt.Fprintln(r.out, pe.Diagram())
+		} else {
+			fmt.Fprintln(r.out, err)
+		}
+		return nil
+	}
+	return s
+}
+
+// printMatches prints the tree path and the start of each node.
+func (r *repl) printMatches(nodes []*html.Node) {
+	for i, n := range nodes {
+		if i == r.limit {
+			fmt.Fprintf(r.out, "... %d more\n", len(nodes)-i)
+			break
+		}
+
+		path := treePath(n)
+		if r.color {
+			path = "\x1b[1;33m" + path + "\x1b[0m"
+		}
+		fmt.Fprintf(r.out, "[%d] %s\n    %s\n", i+1, path, snippet(n, 72))
+	}
+
+	switch len(nodes) {
+	case 0:
+		fmt.Fprintln(r.out, "no matches")
+	case 1:
+		fmt.Fprintln(r.out, "1 match")
+	default:
+		fmt.Fprintf(r.out, "%d matches\n", len(nodes))
+	}
+}
+
+// treePath returns a selector path from the root element to n like
+// "html > body > div#main > p:nth-of-type(2)", which selects n again.
+func treePath(n *html.Node) string {
+	var steps []string
+	for ; n != nil && n.Type == html.ElementNode; n = n.Parent {
+		steps = append(steps, pathStep(n))
+	}
+
+	for i, j := 0, len(steps)-1; i < j; i, j = i+1, j-1 {
+		steps[i], steps[j] = steps[j], steps[i]
+	}
+	return strings.Join(steps, " > ")
+}
+
+func pathStep(n *html.Node) string {
+	for _, a := range n.Attr {
+		if a.Namespace == "" && a.Key == "id" && a.Val != "" {
+			return n.Data + "#" + escapeName(a.Val)
+		}
+	}
+
+	if n.Parent == nil {
+		return n.Data
+	}
+
+	var i, count int
+	for c := n.Parent.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.Data == n.Data {
+			count++
+			if c == n {
+				i = count
+			}
+		}
+	}
+	if count == 1 {
+		return n.Data
+	}
+	return fmt.Sprintf("%s:nth-of-type(%d)", n.Data, i)
+}
+
+// escapeName escapes the characters of an id that cannot appear in a hash selector.
+func escapeName(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '-' || r == '_' || r >= 0x80,
+			'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune('\\')
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// snippet returns the outer html of n on a single line, cut at max runes.
+func snippet(n *html.Node, max int) string {
+	outer, _ := carrot.OuterHTML(n)
+	s := strings.Join(strings.Fields(outer), " ")
+	if rs := []rune(s); len(rs) > max {
+		return string(rs[:max-3]) + "..."
+	}
+	return s
+}
+
+var (
+	expressionType = reflect.TypeOf((*ast.Expression)(nil)).Elem()
+	tokenType      = reflect.TypeOf(token.Token{})
+)
+
+// printAST prints expr and the nodes under it, one per line, indented by depth.
+// name is the field of the parent holding expr.
+func printAST(w io.Writer, indent string, expr ast.Expression, name string) {
+	label := strings.TrimPrefix(reflect.TypeOf(expr).String(), "*ast.")
+	if name != "" {
+		label = name + ": " + label
+	}
+	fmt.Fprintf(w, "%s%s %q\n", indent, label, expr.String())
+
+	v := reflect.ValueOf(expr)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	printFields(w, indent+"  ", v)
+}
+
+// printFields prints the expressions held by the fields of the struct v.
+// Structs that are not expressions, like ast.NArg, are flattened into v.
+func printFields(w io.Writer, indent string, v reflect.Value) {
+	if v.Kind() != reflect.Struct {
+		return
+	}
+
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		name := v.Type().Field(i).Name
+
+		switch {
+		case f.Type() == tokenType:
+		case f.Kind() == reflect.Slice && f.Type().Elem() == expressionType:
+			for j := 0; j < f.Len(); j++ {
+				printAST(w, indent, f.Index(j).Interface().(ast.Expression), fmt.Sprintf("%s[%d]", name, j))
+			}
+		case (f.Kind() == reflect.Ptr || f.Kind() == reflect.Interface) && f.IsNil():
+		case f.Type().Implements(expressionType):
+			printAST(w, indent, f.Interface().(ast.Expression), name)
+		case f.Kind() == reflect.Ptr:
+			printFields(w, indent, f.Elem())
+		}
+	}
+}
+
+func defaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".carrot_history")
+}
+
+// isTerminal reports whether w is a terminal, to color the output.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
@@ -6,12 +6,64 @@ import (
 )
 
 // Eval function evaluate CSS selector
+// Evaluation starts from ctx.CNode and never modifies ctx,
+// so a Context can be shared by concurrent calls to Eval.
+// If ctx.CNode holds all the elements of the document, as it does after
+// SetDoc, each element is matched right to left like Match does.
+//
+// The nodes matched by a selector are returned in document order without
+// duplicates. A group of selectors is in document order as well, unless
+// ctx is set to SelectorOrder, which returns the nodes matched by each
+// selector in turn, leaving out the nodes already returned.
 func Eval(expr ast.Expression, ctx *Context) []*html.Node {
+	q := ctx.query()
+
+	// starting from the whole document, every element is matched
+	// right to left, which does not build the intermediate sets.
+	// Explain traces the steps of the evaluation from left to right.
+	if q.tracer == nil && isAllNodes(q.CNode, q) {
+		return matchOrdered(expr, q)
+	}
+
+	nodes := evalExpr(expr, q)
+
+	// results like that of '*' can be ctx.Nodes itself
+	if len(nodes) > 0 && len(ctx.Nodes) > 0 && &nodes[0] == &ctx.Nodes[0] {
+		nodes = append([]*html.Node(nil), nodes...)
+	}
+	return nodes
+}
+
+// Sort sorts elements of ctx.Doc in document order and removes duplicates.
+// nodes is sorted in place.
+func Sort(nodes []*html.Node, ctx *Context) []*html.Node {
+	sortNodes(nodes, ctx)
+
+	var j int
+	for i, n := range nodes {
+		if i == 0 || n != nodes[j-1] {
+			nodes[j] = n
+			j++
+		}
+	}
+	return nodes[:j]
+}
+
+func evalExpr(expr ast.Expression, ctx *Context) []*html.Node {
+	if ctx.tracer != nil {
+		return ctx.tracer.record(expr, ctx)
+	}
+	return evalNode(expr, ctx)
+}
+
+func evalNode(expr ast.Expression, ctx *Context) []*html.Node {
 	switch expr := expr.(type) {
 	case *ast.Group:
 		return evalGroup(expr, ctx)
 	case *ast.Selector:
 		return evalSelector(expr, ctx)
+	case *ast.RSelector:
+		return evalRSelector(expr, ctx)
 	case *ast.Sequence:
 		return evalSequence(expr, ctx)
 	case *ast.Universal:
@@ -26,6 +78,10 @@ func Eval(expr ast.Expression, ctx *Context) []*html.Node {
 		return evalNegation(expr, ctx)
 	case *ast.Has:
 		return evalHas(expr, ctx)
+	case *ast.Is:
+		return evalIs(expr, ctx)
+	case *ast.Where:
+		return evalWhere(expr, ctx)
 	case *ast.Attrib:
 		return evalAttrib(expr, ctx, false)
 	case *ast.Pseudo:
@@ -1,114 +1,408 @@
 package eval
 
 import (
-	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
+	"time"
+	"unicode/utf8"
 
+	"github.com/zzossig/carrot/ast"
 	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
 )
 
+// Namespace URIs used by html documents.
+const (
+	NamespaceHTML   = "http://www.w3.org/1999/xhtml"
+	NamespaceSVG    = "http://www.w3.org/2000/svg"
+	NamespaceMathML = "http://www.w3.org/1998/Math/MathML"
+	NamespaceXLink  = "http://www.w3.org/1999/xlink"
+	NamespaceXML    = "http://www.w3.org/XML/1998/namespace"
+	NamespaceXMLNS  = "http://www.w3.org/2000/xmlns/"
+)
+
+// defaultNamespaces are the prefixes that can be used without being registered.
+var defaultNamespaces = map[string]string{
+	"html":  NamespaceHTML,
+	"svg":   NamespaceSVG,
+	"math":  NamespaceMathML,
+	"xlink": NamespaceXLink,
+	"xml":   NamespaceXML,
+	"xmlns": NamespaceXMLNS,
+}
+
 // Context contains Nodes that is used in Eval function.
+// Doc and Nodes hold the loaded document. CNode is the set of nodes
+// a selector is evaluated against. Eval works on its own copy of the
+// Context, so once a document is set, the Context is only read.
 type Context struct {
-	Doc   *html.Node
-	Nodes []*html.Node
-	CNode []*html.Node
-	CType string
+	Doc        *html.Node
+	Nodes      []*html.Node
+	CNode      []*html.Node
+	Namespaces map[string]string
+	encoding   encoding.Encoding
+	order      Order
+	scope      *html.Node // element :scope matches, the root element if nil
+	index      *docIndex
+	tracer     *tracer // records the evaluation for Explain
 }
 
+// Order is the order a group of selectors like "h2, h1" returns nodes in.
+type Order int
+
+const (
+	// DocumentOrder returns the nodes of a group in document order,
+	// like querySelectorAll does. It is the default.
+	DocumentOrder Order = iota
+	// SelectorOrder returns the nodes matched by each selector of a group in turn.
+	SelectorOrder
+)
+
 // NewContext creates a new context
 func NewContext() *Context {
 	return &Context{}
 }
 
+// SetNamespace maps a namespace prefix to a namespace uri.
+// An empty prefix sets the default namespace of type selectors.
+// The prefixes html, svg, math, xlink, xml and xmlns are known without being set.
+func (c *Context) SetNamespace(prefix, uri string) {
+	if c.Namespaces == nil {
+		c.Namespaces = make(map[string]string)
+	}
+	c.Namespaces[prefix] = uri
+}
+
+// SetOrder sets the order a group of selectors returns nodes in.
+func (c *Context) SetOrder(o Order) {
+	c.order = o
+}
+
+// lookupNamespace returns the namespace uri of prefix.
+func (c *Context) lookupNamespace(prefix string) (string, bool) {
+	if uri, ok := c.Namespaces[prefix]; ok {
+		return uri, true
+	}
+	if prefix == "" {
+		return "", false
+	}
+	uri, ok := defaultNamespaces[prefix]
+	return uri, ok
+}
+
+// CheckNamespaces returns an error if expr uses a namespace prefix that is
+// neither registered by SetNamespace nor one of the default prefixes.
+// Such a selector is invalid. In :is() and :where(), which forgive invalid
+// selectors, an undeclared prefix only makes its selector match nothing.
+func CheckNamespaces(expr ast.Expression, ctx *Context) error {
+	if prefix, ok := undeclaredPrefix(expr, ctx); ok {
+		return fmt.Errorf("undeclared namespace prefix %q in %s", prefix, expr)
+	}
+	return nil
+}
+
+// undeclaredPrefix returns the first prefix used in expr that is not declared.
+func undeclaredPrefix(expr ast.Expression, ctx *Context) (string, bool) {
+	declared := func(ns *ast.Namespace) bool {
+		if ns == nil || ns.Prefix == "" || ns.Prefix == "*" {
+			return true
+		}
+		_, ok := ctx.lookupNamespace(ns.Prefix)
+		return ok
+	}
+
+	var exprs []ast.Expression
+	switch expr := expr.(type) {
+	case *ast.Group:
+		exprs = expr.Selectors
+	case *ast.Selector:
+		exprs = []ast.Expression{expr.Left, expr.Right}
+	case *ast.RSelector:
+		exprs = []ast.Expression{expr.Expr}
+	case *ast.Sequence:
+		if !declared(expr.Namespace) {
+			return expr.Namespace.Prefix, true
+		}
+		exprs = expr.Exprs
+	case *ast.Attrib:
+		if !declared(expr.Namespace) {
+			return expr.Namespace.Prefix, true
+		}
+	case *ast.Negation:
+		switch expr.TypeID {
+		case 5:
+			exprs = []ast.Expression{expr.NArg.Attrib}
+		case 6:
+			exprs = []ast.Expression{expr.NArg.Pseudo}
+		case 7:
+			exprs = []ast.Expression{expr.NArg.Group}
+		case 8:
+			exprs = []ast.Expression{expr.NArg.Sequence}
+		case 9:
+			exprs = []ast.Expression{expr.NArg.Selector}
+		}
+	case *ast.Has:
+		switch expr.TypeID {
+		case 5:
+			exprs = []ast.Expression{expr.HArg.Attrib}
+		case 6:
+			exprs = []ast.Expression{expr.HArg.Pseudo}
+		case 7:
+			exprs = []ast.Expression{expr.HArg.Group}
+		case 8:
+			exprs = []ast.Expression{expr.HArg.RSelector}
+		}
+	case *ast.Pseudo:
+		if expr.TypeID == 2 && expr.FunctionalPseudo.Arg != nil && expr.FunctionalPseudo.Arg.Of != nil {
+			exprs = []ast.Expression{expr.FunctionalPseudo.Arg.Of}
+		}
+	}
+
+	for _, e := range exprs {
+		if e == nil {
+			continue
+		}
+		if prefix, ok := undeclaredPrefix(e, ctx); ok {
+			return prefix, true
+		}
+	}
+	return "", false
+}
+
+// query returns a copy of the context holding the state of a single evaluation.
+func (c *Context) query() *Context {
+	q := *c
+	return &q
+}
+
+// LoadOptions configures how SetDocContext loads a document.
+// The zero value loads with http.DefaultClient and no limits.
+type LoadOptions struct {
+	Client    *http.Client  // client for http(s) urls, http.DefaultClient if nil
+	Header    http.Header   // additional request headers
+	UserAgent string        // User-Agent request header, if not empty
+	Timeout   time.Duration // time limit of the whole load, no limit if 0
+	MaxSize   int64         // maximum document size in bytes, no limit if 0
+}
+
+// ErrTooLarge is returned when a document exceeds LoadOptions.MaxSize.
+var ErrTooLarge = errors.New("document exceeds the size limit")
+
 // SetDoc set Doc field in a Context
 // input param can be url or local filepath.
 func (c *Context) SetDoc(input string) error {
-	if file, err := os.Open(input); err == nil {
-		defer file.Close()
+	return c.SetDocContext(context.Background(), input, nil)
+}
 
-		buf := bufio.NewReader(file)
-		parsedHTML, err := html.Parse(buf)
-		if err != nil {
-			return err
-		}
+// SetDocContext loads a document from input and sets it to the Context.
+// Inputs with a http or https scheme are fetched with opts.Client,
+// file urls and inputs without a scheme are read from the file system.
+// opts may be nil. The Context is left unchanged if loading fails.
+func (c *Context) SetDocContext(ctx context.Context, input string, opts *LoadOptions) error {
+	if opts == nil {
+		opts = &LoadOptions{}
+	}
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
 
-		c.Doc = parsedHTML
+	var data []byte
+	var contentType string
+	var err error
+
+	u, uerr := url.Parse(input)
+	switch {
+	case uerr == nil && (u.Scheme == "http" || u.Scheme == "https"):
+		data, contentType, err = fetch(ctx, input, opts)
+	case uerr == nil && u.Scheme == "file":
+		data, err = readFile(ctx, u.Path, opts)
+	case uerr != nil || len(u.Scheme) <= 1:
+		// no scheme, or a windows drive letter like C:\
+		data, err = readFile(ctx, input, opts)
+	default:
+		err = fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return fmt.Errorf("loading %s: %w", input, err)
+	}
+
+	parsedHTML, err := c.parse(data, contentType)
+	if err != nil {
+		return fmt.Errorf("loading %s: %w", input, err)
 	}
 
-	if resp, err := http.Get(input); err == nil {
-		defer resp.Body.Close()
+	c.SetDocN(parsedHTML)
+	return nil
+}
 
-		buf := bufio.NewReader(resp.Body)
-		parsedHTML, err := html.Parse(buf)
-		if err != nil {
-			return err
+func fetch(ctx context.Context, input string, opts *LoadOptions) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, input, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	for k, vs := range opts.Header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
 		}
+	}
+	if opts.UserAgent != "" {
+		req.Header.Set("User-Agent", opts.UserAgent)
+	}
 
-		c.Doc = parsedHTML
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
 	}
 
-	if c.Doc != nil {
-		c.CNode = walkDesc(c.Doc)
-		c.Nodes = make([]*html.Node, len(c.CNode))
-		copy(c.Nodes, c.CNode)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
 	}
+	defer resp.Body.Close()
 
-	return nil
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if opts.MaxSize > 0 && resp.ContentLength > opts.MaxSize {
+		return nil, "", ErrTooLarge
+	}
+
+	data, err := readAll(resp.Body, opts.MaxSize)
+	return data, resp.Header.Get("Content-Type"), err
+}
+
+func readFile(ctx context.Context, name string, opts *LoadOptions) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return readAll(file, opts.MaxSize)
+}
+
+// readAll reads r to the end, failing with ErrTooLarge if it is longer than max bytes.
+func readAll(r io.Reader, max int64) ([]byte, error) {
+	if max <= 0 {
+		return ioutil.ReadAll(r)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, ErrTooLarge
+	}
+	return data, nil
 }
 
 // SetDocR set Doc from http.Response
+// The encoding is detected from the Content-Type header and the document.
 func (c *Context) SetDocR(r *http.Response) error {
 	defer r.Body.Close()
 
-	nr := bufio.NewReader(r.Body)
-	parsedHTML, err := html.Parse(nr)
+	data, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		return err
 	}
 
-	c.Doc = parsedHTML
-	if c.Doc != nil {
-		c.CNode = walkDesc(c.Doc)
-		c.Nodes = make([]*html.Node, len(c.CNode))
-		copy(c.Nodes, c.CNode)
+	parsedHTML, err := c.parse(data, r.Header.Get("Content-Type"))
+	if err != nil {
+		return err
 	}
 
+	c.SetDocN(parsedHTML)
 	return nil
 }
 
 // SetDocN set Doc from html.Node
+// CNode and Nodes share the same slice, which Eval never modifies.
 func (c *Context) SetDocN(n *html.Node) {
 	c.Doc = n
 	if c.Doc != nil {
-		c.CNode = walkDesc(c.Doc)
-		c.Nodes = make([]*html.Node, len(c.CNode))
-		copy(c.Nodes, c.CNode)
+		c.Nodes = walkDesc(c.Doc)
+		c.CNode = c.Nodes
+		c.index = &docIndex{}
 	}
 }
 
 // SetDocS set Doc from string
+// A valid UTF-8 string is parsed as it is unless an encoding is set by SetEncoding.
 func (c *Context) SetDocS(s string) error {
-	nr := strings.NewReader(s)
-	parsedHTML, err := html.Parse(nr)
+	var parsedHTML *html.Node
+	var err error
+
+	if c.encoding == nil && utf8.ValidString(s) {
+		parsedHTML, err = html.Parse(strings.NewReader(strings.TrimPrefix(s, "\ufeff")))
+	} else {
+		parsedHTML, err = c.parse([]byte(s), "")
+	}
 	if err != nil {
 		return err
 	}
 
-	c.Doc = parsedHTML
-	if c.Doc != nil {
-		c.CNode = walkDesc(c.Doc)
-		c.Nodes = make([]*html.Node, len(c.CNode))
-		copy(c.Nodes, c.CNode)
+	c.SetDocN(parsedHTML)
+	return nil
+}
+
+// SetEncoding forces the character encoding of documents set afterwards
+// instead of detecting it. label is an encoding name like "shift_jis" or "euc-kr".
+// An empty label turns detection back on.
+func (c *Context) SetEncoding(label string) error {
+	if label == "" {
+		c.encoding = nil
+		return nil
 	}
 
+	e, _ := charset.Lookup(label)
+	if e == nil {
+		return fmt.Errorf("unknown encoding %q", label)
+	}
+	c.encoding = e
 	return nil
 }
 
+// parse transcodes data to UTF-8 and parses it.
+// Unless an encoding is set by SetEncoding, the encoding is detected
+// from a byte order mark, contentType and <meta> tags, in that order.
+// Without a byte order mark or contentType, valid UTF-8 is parsed as it is.
+func (c *Context) parse(data []byte, contentType string) (*html.Node, error) {
+	e := c.encoding
+	if e == nil {
+		var certain bool
+		e, _, certain = charset.DetermineEncoding(data, contentType)
+		// undeclared documents are guessed to be windows-1252, which garbles UTF-8
+		if !certain && utf8.Valid(data) {
+			return html.Parse(bytes.NewReader(data))
+		}
+		// BOMOverride drops the byte order mark the decoders would keep
+		return html.Parse(transform.NewReader(bytes.NewReader(data), unicode.BOMOverride(e.NewDecoder())))
+	}
+
+	return html.Parse(transform.NewReader(bytes.NewReader(data), e.NewDecoder()))
+}
+
 // GetBackCtx resets the context to the initially set context.
+// Eval does not modify the context, so this is only needed
+// after CNode has been changed by hand.
 func (c *Context) GetBackCtx() {
-	c.CType = ""
-	c.CNode = make([]*html.Node, len(c.Nodes))
-	copy(c.CNode, c.Nodes)
+	c.CNode = c.Nodes
 }
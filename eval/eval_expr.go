@@ -1,8 +1,6 @@
 package eval
 
 import (
-	"strings"
-
 	"github.com/zzossig/carrot/ast"
 	"github.com/zzossig/carrot/token"
 	"golang.org/x/net/html"
@@ -12,23 +10,47 @@ func evalGroup(expr ast.Expression, ctx *Context) []*html.Node {
 	g := expr.(*ast.Group)
 	var nodes []*html.Node
 
+	seen := make(map[*html.Node]bool)
+
+	cnode := ctx.CNode
 	for _, selector := range g.Selectors {
-		e := Eval(selector, ctx)
-		for _, ee := range e {
-			nodes = appendNode(nodes, ee)
+		ctx.CNode = cnode
+		for _, n := range evalExpr(selector, ctx) {
+			if !seen[n] {
+				seen[n] = true
+				nodes = append(nodes, n)
+			}
 		}
-		ctx.GetBackCtx()
 	}
 
+	if ctx.order == DocumentOrder {
+		sortNodes(nodes, ctx)
+	}
+
+	ctx.CNode = nodes
 	return nodes
 }
 
+// evalRSelector evaluates a selector starting with a combinator like "> li"
+// relative to :scope.
+func evalRSelector(expr ast.Expression, ctx *Context) []*html.Node {
+	rs := expr.(*ast.RSelector)
+
+	ctx.CNode = fnScope(ctx, false)
+	scope := ctx.CNode
+	ctx.CNode = collectRelative(rs.Token.Type, ctx)
+	ctx.traceStep(combinatorName(rs.Token.Type)+" from :scope", scope, ctx.CNode)
+
+	return evalExpr(rs.Expr, ctx)
+}
+
 func evalSelector(expr ast.Expression, ctx *Context) []*html.Node {
 	s := expr.(*ast.Selector)
 
-	leftNodes := Eval(s.Left, ctx)
+	leftNodes := evalExpr(s.Left, ctx)
 	ctx.CNode = leftNodes
 
+	step := combinatorName(s.Token.Type)
 	switch s.Token.Type {
 	case token.TILDE:
 		ctx.CNode = collectSubSibling(ctx)
@@ -37,10 +59,16 @@ func evalSelector(expr ast.Expression, ctx *Context) []*html.Node {
 	case token.GT:
 		ctx.CNode = collectChild(ctx)
 	case token.S:
-		ctx.CNode = collectDesc(ctx)
+		if nodes, ok := collectDescCandidates(s.Right, ctx); ok {
+			step += " (indexed)"
+			ctx.CNode = nodes
+		} else {
+			ctx.CNode = collectDesc(ctx)
+		}
 	}
+	ctx.traceStep(step, leftNodes, ctx.CNode)
 
-	rightNodes := Eval(s.Right, ctx)
+	rightNodes := evalExpr(s.Right, ctx)
 	ctx.CNode = rightNodes
 
 	return ctx.CNode
@@ -49,42 +77,53 @@ func evalSelector(expr ast.Expression, ctx *Context) []*html.Node {
 func evalSequence(expr ast.Expression, ctx *Context) []*html.Node {
 	s := expr.(*ast.Sequence)
 
-	if ident, ok := s.Expression.(*ast.Ident); ok {
-		ctx.CType = ident.Value
-	}
-
 	if s.Expression != nil {
-		h := Eval(s.Expression, ctx)
+		h := evalExpr(s.Expression, ctx)
 		ctx.CNode = h
 	}
 
+	if _, ok := ctx.lookupNamespace(""); ok || s.Namespace != nil {
+		ctx.CNode = evalNamespace(s.Namespace, ctx)
+	}
+
 	for _, e := range s.Exprs {
-		ss := Eval(e, ctx)
+		ss := evalExpr(e, ctx)
 		ctx.CNode = ss
 	}
 
-	ctx.CType = ""
 	return ctx.CNode
 }
 
+func evalNamespace(ns *ast.Namespace, ctx *Context) []*html.Node {
+	var nodes []*html.Node
+
+	for _, n := range ctx.CNode {
+		if isNamespaceMatched(n, ns, ctx) {
+			nodes = append(nodes, n)
+		}
+	}
+
+	ctx.CNode = nodes
+	return nodes
+}
+
 func evalUniversal(expr ast.Expression, ctx *Context) []*html.Node {
-	return collectDescOrSelf(ctx)
+	return ctx.CNode
 }
 
 func evalClass(expr ast.Expression, ctx *Context) []*html.Node {
 	c := expr.(*ast.Class)
 	var nodes []*html.Node
 
+	if idx := ctx.indexFor(ctx.CNode); idx != nil {
+		nodes = append(nodes, idx.classes[c.Name]...)
+		ctx.CNode = nodes
+		return nodes
+	}
+
 	for _, n := range ctx.CNode {
-		for _, a := range n.Attr {
-			if a.Key == "class" {
-				f := strings.Fields(a.Val)
-				for _, s := range f {
-					if s == c.Name {
-						nodes = appendNode(nodes, n)
-					}
-				}
-			}
+		if hasClass(n, c.Name) {
+			nodes = append(nodes, n)
 		}
 	}
 
@@ -98,15 +137,17 @@ func evalHash(expr ast.Expression, ctx *Context) []*html.Node {
 
 	if h.Name == "" {
 		return nodes
-	} else if strings.ContainsRune("0123456789", rune(h.Name[0])) {
+	}
+
+	if idx := ctx.indexFor(ctx.CNode); idx != nil {
+		nodes = append(nodes, idx.ids[h.Name]...)
+		ctx.CNode = nodes
 		return nodes
 	}
 
 	for _, n := range ctx.CNode {
-		for _, a := range n.Attr {
-			if a.Key == "id" && a.Val == h.Name {
-				nodes = appendNode(nodes, n)
-			}
+		if isIDMatched(n, h.Name) {
+			nodes = append(nodes, n)
 		}
 	}
 
@@ -118,202 +159,16 @@ func evalAttrib(expr ast.Expression, ctx *Context, isNeg bool) []*html.Node {
 	ae := expr.(*ast.Attrib).AttrExpr
 	var nodes []*html.Node
 
-	switch ae.TypeID {
-	case 1:
-		if isNeg {
-			has := false
-			for _, n := range ctx.CNode {
-				for _, a := range n.Attr {
-					if a.Key == ae.Left.Value {
-						has = true
-					}
-				}
-
-				if !has {
-					nodes = appendNode(nodes, n)
-				}
-				has = false
-			}
-		} else {
-			for _, n := range ctx.CNode {
-				for _, a := range n.Attr {
-					if a.Key == ae.Left.Value {
-						nodes = appendNode(nodes, n)
-					}
-				}
+	if isNeg {
+		for _, n := range ctx.CNode {
+			if !isAttrMatched(n, ae, ctx) {
+				nodes = append(nodes, n)
 			}
 		}
-	case 2:
-		switch ae.Token.Type {
-		case token.EQ:
-			if isNeg {
-				has := false
-				for _, n := range ctx.CNode {
-					for _, a := range n.Attr {
-						if a.Key == ae.Left.Value && a.Val == ae.Right.Value {
-							has = true
-						}
-					}
-
-					if !has {
-						nodes = appendNode(nodes, n)
-					}
-					has = false
-				}
-			} else {
-				for _, n := range ctx.CNode {
-					for _, a := range n.Attr {
-						if a.Key == ae.Left.Value && a.Val == ae.Right.Value {
-							nodes = appendNode(nodes, n)
-						}
-					}
-				}
-			}
-		case token.PREFIXMATCH:
-			if isNeg {
-				has := false
-				for _, n := range ctx.CNode {
-					for _, a := range n.Attr {
-						if a.Key == ae.Left.Value {
-							if strings.HasPrefix(a.Val, ae.Right.Value) {
-								has = true
-							}
-						}
-					}
-
-					if !has {
-						nodes = appendNode(nodes, n)
-					}
-					has = false
-				}
-			} else {
-				for _, n := range ctx.CNode {
-					for _, a := range n.Attr {
-						if a.Key == ae.Left.Value {
-							if strings.HasPrefix(a.Val, ae.Right.Value) {
-								nodes = appendNode(nodes, n)
-							}
-						}
-					}
-				}
-			}
-		case token.SUFFIXMATCH:
-			if isNeg {
-				has := false
-				for _, n := range ctx.CNode {
-					for _, a := range n.Attr {
-						if a.Key == ae.Left.Value {
-							if strings.HasSuffix(a.Val, ae.Right.Value) {
-								has = true
-							}
-						}
-					}
-
-					if !has {
-						nodes = appendNode(nodes, n)
-					}
-					has = false
-				}
-			} else {
-				for _, n := range ctx.CNode {
-					for _, a := range n.Attr {
-						if a.Key == ae.Left.Value {
-							if strings.HasSuffix(a.Val, ae.Right.Value) {
-								nodes = appendNode(nodes, n)
-							}
-						}
-					}
-				}
-			}
-		case token.SUBSTRINGMATCH:
-			if isNeg {
-				has := false
-				for _, n := range ctx.CNode {
-					for _, a := range n.Attr {
-						if a.Key == ae.Left.Value {
-							if strings.Contains(a.Val, ae.Right.Value) {
-								has = true
-							}
-						}
-					}
-
-					if !has {
-						nodes = appendNode(nodes, n)
-					}
-					has = false
-				}
-			} else {
-				for _, n := range ctx.CNode {
-					for _, a := range n.Attr {
-						if a.Key == ae.Left.Value {
-							if strings.Contains(a.Val, ae.Right.Value) {
-								nodes = appendNode(nodes, n)
-							}
-						}
-					}
-				}
-			}
-		case token.INCLUDES:
-			if isNeg {
-				has := false
-				for _, n := range ctx.CNode {
-					for _, a := range n.Attr {
-						if a.Key == ae.Left.Value {
-							f := strings.Fields(a.Val)
-							for _, s := range f {
-								if s == ae.Right.Value {
-									has = true
-								}
-							}
-						}
-					}
-
-					if !has {
-						nodes = appendNode(nodes, n)
-					}
-					has = false
-				}
-			} else {
-				for _, n := range ctx.CNode {
-					for _, a := range n.Attr {
-						if a.Key == ae.Left.Value {
-							f := strings.Fields(a.Val)
-							for _, s := range f {
-								if s == ae.Right.Value {
-									nodes = appendNode(nodes, n)
-								}
-							}
-						}
-					}
-				}
-			}
-		case token.DASHMATCH:
-			if isNeg {
-				has := false
-				for _, n := range ctx.CNode {
-					for _, a := range n.Attr {
-						if a.Key == ae.Left.Value {
-							if isDashMatched(a.Val, ae.Right.Value) {
-								has = true
-							}
-						}
-					}
-
-					if !has {
-						nodes = appendNode(nodes, n)
-					}
-					has = false
-				}
-			} else {
-				for _, n := range ctx.CNode {
-					for _, a := range n.Attr {
-						if a.Key == ae.Left.Value {
-							if isDashMatched(a.Val, ae.Right.Value) {
-								nodes = appendNode(nodes, n)
-							}
-						}
-					}
-				}
+	} else {
+		for _, n := range ctx.CNode {
+			if isAttrMatched(n, ae, ctx) {
+				nodes = append(nodes, n)
 			}
 		}
 	}
@@ -326,9 +181,14 @@ func evalIdent(expr ast.Expression, ctx *Context) []*html.Node {
 	i := expr.(*ast.Ident)
 	var nodes []*html.Node
 
-	for _, n := range ctx.CNode {
-		if n.Data == i.Value {
-			nodes = appendNode(nodes, n)
+	cnode := ctx.CNode
+	if idx := ctx.indexFor(cnode); idx != nil {
+		cnode = idx.tags[toASCIILower(i.Value)]
+	}
+
+	for _, n := range cnode {
+		if isTypeMatched(n, i.Value) {
+			nodes = append(nodes, n)
 		}
 	}
 
@@ -343,8 +203,8 @@ func evalNegation(expr ast.Expression, ctx *Context) []*html.Node {
 	switch na.TypeID {
 	case 1:
 		for _, n := range ctx.CNode {
-			if n.Data != na.Ident.Value {
-				nodes = appendNode(nodes, n)
+			if !isTypeMatched(n, na.Ident.Value) {
+				nodes = append(nodes, n)
 			}
 		}
 	case 2:
@@ -362,54 +222,30 @@ func evalNegation(expr ast.Expression, ctx *Context) []*html.Node {
 			}
 
 			if !hasID {
-				nodes = appendNode(nodes, n)
+				nodes = append(nodes, n)
 			} else if idVal != "" && idVal != na.Hash.Name {
-				nodes = appendNode(nodes, n)
+				nodes = append(nodes, n)
 			}
 
 			hasID = false
 			idVal = ""
 		}
 	case 4:
-		hasClass := false
-		classVal := ""
-
 		for _, n := range ctx.CNode {
-			for _, a := range n.Attr {
-				if a.Key == "class" {
-					hasClass = true
-					f := strings.Fields(a.Val)
-
-					for _, s := range f {
-						if s == na.Class.Name {
-							classVal = s
-						}
-					}
-				}
+			if !hasClass(n, na.Class.Name) {
+				nodes = append(nodes, n)
 			}
-
-			if !hasClass {
-				nodes = appendNode(nodes, n)
-			} else if classVal != "" && classVal != na.Class.Name {
-				nodes = appendNode(nodes, n)
-			}
-
-			hasClass = false
-			classVal = ""
 		}
 	case 5:
 		nodes = evalAttrib(na.Attrib, ctx, true)
 	case 6:
 		nodes = evalPseudo(na.Pseudo, ctx, true)
 	case 7:
-		for _, selector := range na.Group.Selectors {
-			negation := makeNegation(selector)
-			if negation == nil {
-				continue
-			}
-			nodes = evalNegation(negation, ctx)
-			ctx.CNode = nodes
-		}
+		nodes = filterUnmatched(na.Group.Selectors, ctx)
+	case 8:
+		nodes = filterUnmatched([]ast.Expression{na.Sequence}, ctx)
+	case 9:
+		nodes = filterUnmatched([]ast.Expression{na.Selector}, ctx)
 	}
 
 	ctx.CNode = nodes
@@ -419,16 +255,74 @@ func evalNegation(expr ast.Expression, ctx *Context) []*html.Node {
 func evalHas(expr ast.Expression, ctx *Context) []*html.Node {
 	has := expr.(*ast.Has).HArg
 	var nodes []*html.Node
+	var args []ast.Expression
 
 	switch has.TypeID {
 	case 1:
+		args = append(args, has.Ident)
 	case 2:
+		args = append(args, has.Universal)
 	case 3:
+		args = append(args, has.Hash)
 	case 4:
+		args = append(args, has.Class)
 	case 5:
+		args = append(args, has.Attrib)
 	case 6:
+		args = append(args, has.Pseudo)
 	case 7:
+		args = append(args, has.Group.Selectors...)
 	case 8:
+		args = append(args, has.RSelector)
+	}
+
+	for _, n := range ctx.CNode {
+		for _, arg := range args {
+			if isRelativeMatched(n, arg, ctx) {
+				nodes = append(nodes, n)
+				break
+			}
+		}
+	}
+
+	ctx.CNode = nodes
+	return nodes
+}
+
+func evalIs(expr ast.Expression, ctx *Context) []*html.Node {
+	is := expr.(*ast.Is)
+	return filterMatched(is.Selectors, ctx)
+}
+
+func evalWhere(expr ast.Expression, ctx *Context) []*html.Node {
+	where := expr.(*ast.Where)
+	return filterMatched(where.Selectors, ctx)
+}
+
+// filterUnmatched keeps the nodes in ctx.CNode that are not matched by any of sels.
+func filterUnmatched(sels []ast.Expression, ctx *Context) []*html.Node {
+	var nodes []*html.Node
+
+	matched := collectMatched(sels, ctx)
+	for _, n := range ctx.CNode {
+		if !matched[n] {
+			nodes = append(nodes, n)
+		}
+	}
+
+	ctx.CNode = nodes
+	return nodes
+}
+
+// filterMatched keeps the nodes in ctx.CNode that are matched by any of sels.
+func filterMatched(sels []ast.Expression, ctx *Context) []*html.Node {
+	var nodes []*html.Node
+
+	matched := collectMatched(sels, ctx)
+	for _, n := range ctx.CNode {
+		if matched[n] {
+			nodes = append(nodes, n)
+		}
 	}
 
 	ctx.CNode = nodes
@@ -0,0 +1,153 @@
+package eval
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/zzossig/carrot/ast"
+	"golang.org/x/net/html"
+)
+
+// docIndex maps ids, classes and tag names of a document to its elements
+// in document order. It is built on first use and shared by the copies
+// of the Context made by Eval, so it is built once per document.
+type docIndex struct {
+	once    sync.Once
+	ids     map[string][]*html.Node
+	classes map[string][]*html.Node
+	tags    map[string][]*html.Node // keyed by the lower-cased tag name
+	order   map[*html.Node]int      // position in document order
+	built   uint32                  // set to 1 once the maps are built
+}
+
+func (idx *docIndex) build(nodes []*html.Node) {
+	idx.once.Do(func() {
+		idx.ids = make(map[string][]*html.Node)
+		idx.classes = make(map[string][]*html.Node)
+		idx.tags = make(map[string][]*html.Node)
+		idx.order = make(map[*html.Node]int, len(nodes))
+
+		for i, n := range nodes {
+			idx.order[n] = i
+			tag := toASCIILower(n.Data)
+			idx.tags[tag] = append(idx.tags[tag], n)
+
+			for _, a := range n.Attr {
+				switch a.Key {
+				case "id":
+					idx.ids[a.Val] = append(idx.ids[a.Val], n)
+				case "class":
+					seen := make(map[string]bool)
+					for _, c := range strings.Fields(a.Val) {
+						if !seen[c] {
+							seen[c] = true
+							idx.classes[c] = append(idx.classes[c], n)
+						}
+					}
+				}
+			}
+		}
+		atomic.StoreUint32(&idx.built, 1)
+	})
+}
+
+// candidates returns the elements seq can match, looked up by the id, class
+// or type selector of seq. It returns false if seq has none of them.
+// The returned slice is shared and must not be modified.
+func (idx *docIndex) candidates(seq *ast.Sequence) ([]*html.Node, bool) {
+	for _, e := range seq.Exprs {
+		if h, ok := e.(*ast.Hash); ok {
+			return idx.ids[h.Name], true
+		}
+	}
+	for _, e := range seq.Exprs {
+		if c, ok := e.(*ast.Class); ok {
+			return idx.classes[c.Name], true
+		}
+	}
+	if i, ok := seq.Expression.(*ast.Ident); ok {
+		return idx.tags[toASCIILower(i.Value)], true
+	}
+	return nil, false
+}
+
+// docIndex returns the index of the document, or nil if no document is set.
+func (c *Context) docIndex() *docIndex {
+	if c.index == nil {
+		return nil
+	}
+	c.index.build(c.Nodes)
+	return c.index
+}
+
+// builtIndex returns the index of the document if it has already been built,
+// or nil. It is used where building the index costs more than it saves.
+func (c *Context) builtIndex() *docIndex {
+	if c.index == nil || atomic.LoadUint32(&c.index.built) == 0 {
+		return nil
+	}
+	return c.index
+}
+
+// indexFor returns the index of the document if nodes is the set of all
+// elements of the document, which is the case at the start of an evaluation.
+// It returns nil otherwise.
+func (c *Context) indexFor(nodes []*html.Node) *docIndex {
+	if !isAllNodes(nodes, c) {
+		return nil
+	}
+	return c.docIndex()
+}
+
+// isAllNodes reports whether nodes is ctx.Nodes, the set of all elements of the document.
+func isAllNodes(nodes []*html.Node, ctx *Context) bool {
+	return len(nodes) != 0 && len(nodes) == len(ctx.Nodes) && &nodes[0] == &ctx.Nodes[0]
+}
+
+// collectDescCandidates collects the descendants of ctx.CNode that the
+// leftmost sequence of right can match, using the index instead of walking
+// the subtrees. It returns false if the sequence cannot be looked up.
+func collectDescCandidates(right ast.Expression, ctx *Context) ([]*html.Node, bool) {
+	idx := ctx.docIndex()
+	if idx == nil {
+		return nil, false
+	}
+
+	seq := leftmostSequence(right)
+	if seq == nil {
+		return nil, false
+	}
+	cands, ok := idx.candidates(seq)
+	if !ok {
+		return nil, false
+	}
+
+	anchors := make(map[*html.Node]bool, len(ctx.CNode))
+	for _, n := range ctx.CNode {
+		anchors[n] = true
+	}
+
+	var nodes []*html.Node
+	for _, n := range cands {
+		for p := n.Parent; p != nil; p = p.Parent {
+			if anchors[p] {
+				nodes = append(nodes, n)
+				break
+			}
+		}
+	}
+
+	return nodes, true
+}
+
+// leftmostSequence returns the sequence a selector starts with.
+func leftmostSequence(expr ast.Expression) *ast.Sequence {
+	switch expr := expr.(type) {
+	case *ast.Sequence:
+		return expr
+	case *ast.Selector:
+		return leftmostSequence(expr.Left)
+	}
+	return nil
+}
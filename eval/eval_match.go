@@ -0,0 +1,349 @@
+package eval
+
+import (
+	"github.com/zzossig/carrot/ast"
+	"github.com/zzossig/carrot/token"
+	"golang.org/x/net/html"
+)
+
+// Matcher reports whether an element is matched by a compiled selector.
+type Matcher func(n *html.Node) bool
+
+// Compile compiles expr into a Matcher that works right to left like browsers do:
+// the last sequence of a selector is checked against the element first, and the
+// combinators are followed up through its ancestors and previous siblings.
+// The Matcher only sees the elements under ctx.Doc, and ctx.Doc itself if it is
+// the root element of a detached tree, like one made by html.ParseFragment.
+func Compile(expr ast.Expression, ctx *Context) Matcher {
+	return compileExpr(expr, ctx.query())
+}
+
+// Match returns the elements of ctx.CNode matched by expr in document order.
+// Unlike Eval, which starts from ctx.CNode and follows the combinators from
+// there, only the last sequence of the selector has to match an element of
+// ctx.CNode. The other sequences can match any element under ctx.Doc.
+func Match(expr ast.Expression, ctx *Context) []*html.Node {
+	return matchNodes(expr, ctx.query())
+}
+
+// Find returns the descendants of root matched by expr. Like querySelectorAll
+// on an element, the selector is matched against the whole document under
+// ctx.Doc, so "body p" finds the p elements under root if root is in the body.
+// :scope matches root, and a selector starting with a combinator like "> li"
+// is relative to root. A group is returned in the order set by ctx.SetOrder.
+func Find(root *html.Node, expr ast.Expression, ctx *Context) []*html.Node {
+	q := ctx.query()
+	q.scope = root
+	q.CNode = walkDesc(root)
+	return matchOrdered(expr, q)
+}
+
+// matchOrdered is like matchNodes, but returns a group in the order set by
+// ctx.SetOrder: SelectorOrder returns the nodes of each selector in turn.
+func matchOrdered(expr ast.Expression, ctx *Context) []*html.Node {
+	g, ok := expr.(*ast.Group)
+	if !ok || ctx.order != SelectorOrder {
+		return matchNodes(expr, ctx)
+	}
+
+	var nodes []*html.Node
+	seen := make(map[*html.Node]bool)
+	for _, sel := range g.Selectors {
+		for _, n := range matchNodes(sel, ctx) {
+			if !seen[n] {
+				seen[n] = true
+				nodes = append(nodes, n)
+			}
+		}
+	}
+	return nodes
+}
+
+// Matches reports whether the element n is matched by expr, like Element.matches:
+// :scope matches n. Like Compile, only the elements under ctx.Doc, or a detached
+// root, can match.
+func Matches(n *html.Node, expr ast.Expression, ctx *Context) bool {
+	if n.Type != html.ElementNode || (n == ctx.Doc && !isDetachedRoot(n)) {
+		return false
+	}
+
+	q := ctx.query()
+	q.scope = n
+	return compileExpr(expr, q)(n)
+}
+
+// Closest returns n or its nearest ancestor matched by expr, or nil if there is none.
+// Like Element.closest, :scope matches n. Like Compile, only the elements under
+// ctx.Doc, or a detached root, are looked at.
+func Closest(n *html.Node, expr ast.Expression, ctx *Context) *html.Node {
+	q := ctx.query()
+	q.scope = n
+
+	m := compileExpr(expr, q)
+	for ; n != nil && (n != ctx.Doc || isDetachedRoot(n)); n = n.Parent {
+		if n.Type == html.ElementNode && m(n) {
+			return n
+		}
+	}
+	return nil
+}
+
+// matchNodes filters ctx.CNode with the Matcher compiled from expr.
+func matchNodes(expr ast.Expression, ctx *Context) []*html.Node {
+	m := compileExpr(expr, ctx)
+
+	cands := ctx.CNode
+	if idx := ctx.indexFor(cands); idx != nil {
+		if seq := rightmostSequence(expr); seq != nil {
+			if c, ok := idx.candidates(seq); ok {
+				cands = c
+			}
+		}
+	}
+
+	var nodes []*html.Node
+	for _, n := range cands {
+		if m(n) {
+			nodes = append(nodes, n)
+		}
+	}
+
+	return nodes
+}
+
+func compileExpr(expr ast.Expression, ctx *Context) Matcher {
+	switch expr := expr.(type) {
+	case *ast.Group:
+		return compileAny(expr.Selectors, ctx)
+	case *ast.Selector:
+		return compileSelector(expr, ctx)
+	case *ast.RSelector:
+		return compileSelector(scopeSelector(expr), ctx)
+	case *ast.Sequence:
+		return compileSequence(expr, ctx)
+	case *ast.Universal:
+		return func(n *html.Node) bool { return true }
+	case *ast.Ident:
+		return func(n *html.Node) bool { return isTypeMatched(n, expr.Value) }
+	case *ast.Class:
+		return func(n *html.Node) bool { return hasClass(n, expr.Name) }
+	case *ast.Hash:
+		return func(n *html.Node) bool { return expr.Name != "" && isIDMatched(n, expr.Name) }
+	case *ast.Attrib:
+		return func(n *html.Node) bool { return isAttrMatched(n, expr.AttrExpr, ctx) }
+	case *ast.Negation:
+		return compileNegation(expr, ctx)
+	case *ast.Is:
+		return compileAny(expr.Selectors, ctx)
+	case *ast.Where:
+		return compileAny(expr.Selectors, ctx)
+	case *ast.Pseudo:
+		if expr.TypeID == 2 && expr.FunctionalPseudo.Arg.Of != nil {
+			return compileNthOf(expr.FunctionalPseudo, ctx)
+		}
+	}
+
+	// the rest only looks at the element itself,
+	// so the set-based evaluator can check it on its own
+	return compileSingle(expr, ctx)
+}
+
+// compileSingle matches an element by evaluating expr with the element as the only node.
+func compileSingle(expr ast.Expression, ctx *Context) Matcher {
+	return func(n *html.Node) bool {
+		q := ctx.query()
+		q.CNode = []*html.Node{n}
+		return len(evalExpr(expr, q)) > 0
+	}
+}
+
+func compileAny(sels []ast.Expression, ctx *Context) Matcher {
+	ms := make([]Matcher, len(sels))
+	for i, sel := range sels {
+		ms[i] = compileExpr(sel, ctx)
+	}
+
+	return func(n *html.Node) bool {
+		for _, m := range ms {
+			if m(n) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func compileSequence(seq *ast.Sequence, ctx *Context) Matcher {
+	var ms []Matcher
+
+	if seq.Expression != nil {
+		ms = append(ms, compileExpr(seq.Expression, ctx))
+	}
+	if _, ok := ctx.lookupNamespace(""); ok || seq.Namespace != nil {
+		ns := seq.Namespace
+		ms = append(ms, func(n *html.Node) bool { return isNamespaceMatched(n, ns, ctx) })
+	}
+	for _, e := range seq.Exprs {
+		ms = append(ms, compileExpr(e, ctx))
+	}
+
+	return func(n *html.Node) bool {
+		for _, m := range ms {
+			if !m(n) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// compileSelector compiles a complex selector. The parser nests selectors to the
+// right, so "a > b c" is flattened into the sequences a, b, c and the combinators > and ' '.
+func compileSelector(s *ast.Selector, ctx *Context) Matcher {
+	var seqs []Matcher
+	var combs []token.Type
+
+	var expr ast.Expression = s
+	for {
+		sel, ok := expr.(*ast.Selector)
+		if !ok {
+			seqs = append(seqs, compileExpr(expr, ctx))
+			break
+		}
+		seqs = append(seqs, compileExpr(sel.Left, ctx))
+		combs = append(combs, sel.Token.Type)
+		expr = sel.Right
+	}
+
+	// matchAt reports whether n is matched by seqs[i] and
+	// the part of the selector on its left.
+	var matchAt func(i int, n *html.Node) bool
+	matchAt = func(i int, n *html.Node) bool {
+		if !seqs[i](n) {
+			return false
+		}
+		if i == 0 {
+			return true
+		}
+
+		switch combs[i-1] {
+		case token.GT:
+			p := parentElement(n, ctx)
+			return p != nil && matchAt(i-1, p)
+		case token.PLUS:
+			s := prevElement(n)
+			return s != nil && matchAt(i-1, s)
+		case token.TILDE:
+			for s := prevElement(n); s != nil; s = prevElement(s) {
+				if matchAt(i-1, s) {
+					return true
+				}
+			}
+		default:
+			for p := parentElement(n, ctx); p != nil; p = parentElement(p, ctx) {
+				if matchAt(i-1, p) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	last := len(seqs) - 1
+	return func(n *html.Node) bool {
+		return matchAt(last, n)
+	}
+}
+
+// scopeSelector turns a relative selector like "> li" into ":scope > li".
+func scopeSelector(rs *ast.RSelector) *ast.Selector {
+	scope := &ast.Sequence{Exprs: []ast.Expression{
+		&ast.Pseudo{TypeID: 1, Ident: &ast.Ident{Value: "scope"}},
+	}}
+	return &ast.Selector{Left: scope, Token: rs.Token, Right: rs.Expr}
+}
+
+func compileNegation(neg *ast.Negation, ctx *Context) Matcher {
+	var sels []ast.Expression
+	switch neg.TypeID {
+	case 7:
+		sels = neg.Group.Selectors
+	case 8:
+		sels = []ast.Expression{neg.Sequence}
+	case 9:
+		sels = []ast.Expression{neg.Selector}
+	default:
+		return compileSingle(neg, ctx)
+	}
+
+	m := compileAny(sels, ctx)
+	return func(n *html.Node) bool {
+		return !m(n)
+	}
+}
+
+// compileNthOf compiles :nth-child(An+B of S) and :nth-last-child(An+B of S).
+func compileNthOf(fp *ast.FunctionalPseudo, ctx *Context) Matcher {
+	of := compileExpr(fp.Arg.Of, ctx)
+	a, b := nthValues(fp.Arg)
+	fromLast := fp.Token.Literal == "nth-last-child"
+
+	return func(n *html.Node) bool {
+		if n.Parent == nil || !of(n) {
+			return false
+		}
+
+		i := 1
+		if fromLast {
+			for s := n.NextSibling; s != nil; s = s.NextSibling {
+				if s.Type == html.ElementNode && of(s) {
+					i++
+				}
+			}
+		} else {
+			for s := n.PrevSibling; s != nil; s = s.PrevSibling {
+				if s.Type == html.ElementNode && of(s) {
+					i++
+				}
+			}
+		}
+		return isNth(i, a, b)
+	}
+}
+
+// parentElement returns the parent of n if it is an element under ctx.Doc,
+// or ctx.Doc itself if it is a detached root.
+func parentElement(n *html.Node, ctx *Context) *html.Node {
+	p := n.Parent
+	if p == nil || p.Type != html.ElementNode || p == ctx.Doc && !isDetachedRoot(p) {
+		return nil
+	}
+	return p
+}
+
+// isDetachedRoot reports whether n is an element without a parent. Unlike a
+// document node, it is an element of its tree and can be matched.
+func isDetachedRoot(n *html.Node) bool {
+	return n.Type == html.ElementNode && n.Parent == nil
+}
+
+// prevElement returns the previous sibling element of n.
+func prevElement(n *html.Node) *html.Node {
+	for s := n.PrevSibling; s != nil; s = s.PrevSibling {
+		if s.Type == html.ElementNode {
+			return s
+		}
+	}
+	return nil
+}
+
+// rightmostSequence returns the sequence a selector ends with.
+func rightmostSequence(expr ast.Expression) *ast.Sequence {
+	switch expr := expr.(type) {
+	case *ast.Sequence:
+		return expr
+	case *ast.Selector:
+		return rightmostSequence(expr.Right)
+	}
+	return nil
+}
@@ -24,6 +24,8 @@ func evalPIdent(ident *ast.Ident, ctx *Context, isNeg bool) []*html.Node {
 		return fnEmpty(ctx, isNeg)
 	case "root":
 		return fnRoot(ctx, isNeg)
+	case "scope":
+		return fnScope(ctx, isNeg)
 	}
 	return nodes
 }
@@ -48,13 +50,13 @@ func fnFirstChild(ctx *Context, isNeg bool) []*html.Node {
 	if isNeg {
 		for _, n := range ctx.CNode {
 			if !isFirstChild(n) {
-				nodes = appendNode(nodes, n)
+				nodes = append(nodes, n)
 			}
 		}
 	} else {
 		for _, n := range ctx.CNode {
 			if isFirstChild(n) {
-				nodes = appendNode(nodes, n)
+				nodes = append(nodes, n)
 			}
 		}
 	}
@@ -68,13 +70,13 @@ func fnLastChild(ctx *Context, isNeg bool) []*html.Node {
 	if isNeg {
 		for _, n := range ctx.CNode {
 			if !isLastChild(n) {
-				nodes = appendNode(nodes, n)
+				nodes = append(nodes, n)
 			}
 		}
 	} else {
 		for _, n := range ctx.CNode {
 			if isLastChild(n) {
-				nodes = appendNode(nodes, n)
+				nodes = append(nodes, n)
 			}
 		}
 	}
@@ -87,14 +89,14 @@ func fnFirstOfType(ctx *Context, isNeg bool) []*html.Node {
 
 	if isNeg {
 		for _, n := range ctx.CNode {
-			if !isFirstOfType(n, ctx.CType) {
-				nodes = appendNode(nodes, n)
+			if !isFirstOfType(n, n.Data) {
+				nodes = append(nodes, n)
 			}
 		}
 	} else {
 		for _, n := range ctx.CNode {
-			if isFirstOfType(n, ctx.CType) {
-				nodes = appendNode(nodes, n)
+			if isFirstOfType(n, n.Data) {
+				nodes = append(nodes, n)
 			}
 		}
 	}
@@ -107,14 +109,14 @@ func fnLastOfType(ctx *Context, isNeg bool) []*html.Node {
 
 	if isNeg {
 		for _, n := range ctx.CNode {
-			if !isLastOfType(n, ctx.CType) {
-				nodes = appendNode(nodes, n)
+			if !isLastOfType(n, n.Data) {
+				nodes = append(nodes, n)
 			}
 		}
 	} else {
 		for _, n := range ctx.CNode {
-			if isLastOfType(n, ctx.CType) {
-				nodes = appendNode(nodes, n)
+			if isLastOfType(n, n.Data) {
+				nodes = append(nodes, n)
 			}
 		}
 	}
@@ -128,13 +130,13 @@ func fnOnlyChild(ctx *Context, isNeg bool) []*html.Node {
 	if isNeg {
 		for _, n := range ctx.CNode {
 			if !isOnlyChlid(n) {
-				nodes = appendNode(nodes, n)
+				nodes = append(nodes, n)
 			}
 		}
 	} else {
 		for _, n := range ctx.CNode {
 			if isOnlyChlid(n) {
-				nodes = appendNode(nodes, n)
+				nodes = append(nodes, n)
 			}
 		}
 	}
@@ -147,14 +149,14 @@ func fnOnlyOfType(ctx *Context, isNeg bool) []*html.Node {
 
 	if isNeg {
 		for _, n := range ctx.CNode {
-			if !isOnlyOfType(n, ctx.CType) {
-				nodes = appendNode(nodes, n)
+			if !isOnlyOfType(n, n.Data) {
+				nodes = append(nodes, n)
 			}
 		}
 	} else {
 		for _, n := range ctx.CNode {
-			if isOnlyOfType(n, ctx.CType) {
-				nodes = appendNode(nodes, n)
+			if isOnlyOfType(n, n.Data) {
+				nodes = append(nodes, n)
 			}
 		}
 	}
@@ -168,13 +170,13 @@ func fnEmpty(ctx *Context, isNeg bool) []*html.Node {
 	if isNeg {
 		for _, n := range ctx.CNode {
 			if n.FirstChild != nil {
-				nodes = appendNode(nodes, n)
+				nodes = append(nodes, n)
 			}
 		}
 	} else {
 		for _, n := range ctx.CNode {
 			if n.FirstChild == nil {
-				nodes = appendNode(nodes, n)
+				nodes = append(nodes, n)
 			}
 		}
 	}
@@ -184,78 +186,17 @@ func fnEmpty(ctx *Context, isNeg bool) []*html.Node {
 
 func fnRoot(ctx *Context, isNeg bool) []*html.Node {
 	var nodes []*html.Node
-	if ctx.Doc.FirstChild != nil && ctx.CType == ctx.Doc.FirstChild.Data {
-		if isNeg {
-			ctx.CNode = []*html.Node{ctx.Doc.FirstChild}
-			nodes = collectDesc(ctx)
-		} else {
-			nodes = appendNode(nodes, ctx.Doc.FirstChild)
-		}
-	}
-	return nodes
-}
 
-func nthChild(arg *ast.Arg, ctx *Context, isNeg bool) []*html.Node {
-	var nodes []*html.Node
-
-	switch arg.TypeID {
-	case 1:
-		if isNeg {
-			for _, n := range ctx.CNode {
-				if !isNthChild(n, arg.Dimension) {
-					nodes = appendNode(nodes, n)
-				}
-			}
-		} else {
-			for _, n := range ctx.CNode {
-				if isNthChild(n, arg.Dimension) {
-					nodes = appendNode(nodes, n)
-				}
-			}
-		}
-	case 2:
-		if isNeg {
-			for _, n := range ctx.CNode {
-				if !isNChild(n, arg.Number.Value) {
-					nodes = appendNode(nodes, n)
-				}
-			}
-		} else {
-			for _, n := range ctx.CNode {
-				if isNChild(n, arg.Number.Value) {
-					nodes = appendNode(nodes, n)
-				}
+	if isNeg {
+		for _, n := range ctx.CNode {
+			if !isRoot(n, ctx.Doc) {
+				nodes = append(nodes, n)
 			}
 		}
-	case 4:
-		switch arg.Ident.Value {
-		case "even":
-			if isNeg {
-				for _, n := range ctx.CNode {
-					if !isEvenChild(n) {
-						nodes = appendNode(nodes, n)
-					}
-				}
-			} else {
-				for _, n := range ctx.CNode {
-					if isEvenChild(n) {
-						nodes = appendNode(nodes, n)
-					}
-				}
-			}
-		case "odd":
-			if isNeg {
-				for _, n := range ctx.CNode {
-					if !isOddChild(n) {
-						nodes = appendNode(nodes, n)
-					}
-				}
-			} else {
-				for _, n := range ctx.CNode {
-					if isOddChild(n) {
-						nodes = appendNode(nodes, n)
-					}
-				}
+	} else {
+		for _, n := range ctx.CNode {
+			if isRoot(n, ctx.Doc) {
+				nodes = append(nodes, n)
 			}
 		}
 	}
@@ -263,204 +204,80 @@ func nthChild(arg *ast.Arg, ctx *Context, isNeg bool) []*html.Node {
 	return nodes
 }
 
-func nthLastChild(arg *ast.Arg, ctx *Context, isNeg bool) []*html.Node {
-	var nodes []*html.Node
+// fnScope matches the element a query is scoped to by Find.
+// Without one, :scope is the same as :root.
+func fnScope(ctx *Context, isNeg bool) []*html.Node {
+	if ctx.scope == nil {
+		return fnRoot(ctx, isNeg)
+	}
 
-	switch arg.TypeID {
-	case 1:
-		if isNeg {
-			for _, n := range ctx.CNode {
-				if !isNthLastChild(n, arg.Dimension) {
-					nodes = appendNode(nodes, n)
-				}
-			}
-		} else {
-			for _, n := range ctx.CNode {
-				if isNthLastChild(n, arg.Dimension) {
-					nodes = appendNode(nodes, n)
-				}
-			}
-		}
-	case 2:
-		if isNeg {
-			for _, n := range ctx.CNode {
-				if !isNLastChild(n, arg.Number.Value) {
-					nodes = appendNode(nodes, n)
-				}
-			}
-		} else {
-			for _, n := range ctx.CNode {
-				if isNLastChild(n, arg.Number.Value) {
-					nodes = appendNode(nodes, n)
-				}
-			}
-		}
-	case 4:
-		switch arg.Ident.Value {
-		case "even":
-			if isNeg {
-				for _, n := range ctx.CNode {
-					if !isEvenLastChild(n) {
-						nodes = appendNode(nodes, n)
-					}
-				}
-			} else {
-				for _, n := range ctx.CNode {
-					if isEvenLastChild(n) {
-						nodes = appendNode(nodes, n)
-					}
-				}
-			}
-		case "odd":
-			if isNeg {
-				for _, n := range ctx.CNode {
-					if !isOddLastChild(n) {
-						nodes = appendNode(nodes, n)
-					}
-				}
-			} else {
-				for _, n := range ctx.CNode {
-					if isOddLastChild(n) {
-						nodes = appendNode(nodes, n)
-					}
-				}
-			}
+	var nodes []*html.Node
+	for _, n := range ctx.CNode {
+		if (n == ctx.scope) != isNeg {
+			nodes = append(nodes, n)
 		}
 	}
 
 	return nodes
 }
 
-func nthOfType(arg *ast.Arg, ctx *Context, isNeg bool) []*html.Node {
+func nthChild(arg *ast.Arg, ctx *Context, isNeg bool) []*html.Node {
+	if arg.Of != nil {
+		return nthChildOf(arg, ctx, isNeg, false)
+	}
+	return nthFilter(arg, ctx, isNeg, false, false)
+}
+
+// nthChildOf evaluates :nth-child(An+B of S) and :nth-last-child(An+B of S).
+// Only the siblings matched by S are counted and a node not matched by S never matches.
+func nthChildOf(arg *ast.Arg, ctx *Context, isNeg, fromLast bool) []*html.Node {
 	var nodes []*html.Node
 
-	switch arg.TypeID {
-	case 1:
-		if isNeg {
-			for _, n := range ctx.CNode {
-				if !isNthOfType(n, arg.Dimension, ctx.CType) {
-					nodes = appendNode(nodes, n)
-				}
-			}
-		} else {
-			for _, n := range ctx.CNode {
-				if isNthOfType(n, arg.Dimension, ctx.CType) {
-					nodes = appendNode(nodes, n)
-				}
-			}
-		}
-	case 2:
-		if isNeg {
-			for _, n := range ctx.CNode {
-				if !isNOfType(n, arg.Number.Value, ctx.CType) {
-					nodes = appendNode(nodes, n)
-				}
-			}
-		} else {
-			for _, n := range ctx.CNode {
-				if isNOfType(n, arg.Number.Value, ctx.CType) {
-					nodes = appendNode(nodes, n)
-				}
-			}
-		}
-	case 4:
-		switch arg.Ident.Value {
-		case "even":
-			if isNeg {
-				for _, n := range ctx.CNode {
-					if !isEvenNthOfType(n, ctx.CType) {
-						nodes = appendNode(nodes, n)
-					}
-				}
-			} else {
-				for _, n := range ctx.CNode {
-					if isEvenNthOfType(n, ctx.CType) {
-						nodes = appendNode(nodes, n)
-					}
-				}
-			}
-		case "odd":
-			if isNeg {
-				for _, n := range ctx.CNode {
-					if !isOddNthOfType(n, ctx.CType) {
-						nodes = appendNode(nodes, n)
-					}
-				}
-			} else {
-				for _, n := range ctx.CNode {
-					if isOddNthOfType(n, ctx.CType) {
-						nodes = appendNode(nodes, n)
-					}
-				}
-			}
+	var sels []ast.Expression
+	if g, ok := arg.Of.(*ast.Group); ok {
+		sels = g.Selectors
+	} else {
+		sels = []ast.Expression{arg.Of}
+	}
+	matched := collectMatched(sels, ctx)
+
+	a, b := nthValues(arg)
+	for _, n := range ctx.CNode {
+		ok := matched[n] && isNth(nthIndexOf(n, matched, fromLast), a, b)
+		if ok != isNeg {
+			nodes = append(nodes, n)
 		}
 	}
 
 	return nodes
 }
 
+func nthLastChild(arg *ast.Arg, ctx *Context, isNeg bool) []*html.Node {
+	if arg.Of != nil {
+		return nthChildOf(arg, ctx, isNeg, true)
+	}
+	return nthFilter(arg, ctx, isNeg, true, false)
+}
+
+func nthOfType(arg *ast.Arg, ctx *Context, isNeg bool) []*html.Node {
+	return nthFilter(arg, ctx, isNeg, false, true)
+}
+
 func nthLastOfType(arg *ast.Arg, ctx *Context, isNeg bool) []*html.Node {
+	return nthFilter(arg, ctx, isNeg, true, true)
+}
+
+// nthFilter returns the nodes whose index among their siblings is An+B,
+// counted from the last sibling if fromLast is true and among the siblings
+// of the same type if ofType is true.
+func nthFilter(arg *ast.Arg, ctx *Context, isNeg, fromLast, ofType bool) []*html.Node {
 	var nodes []*html.Node
 
-	switch arg.TypeID {
-	case 1:
-		if isNeg {
-			for _, n := range ctx.CNode {
-				if !isNthLastOfType(n, arg.Dimension, ctx.CType) {
-					nodes = appendNode(nodes, n)
-				}
-			}
-		} else {
-			for _, n := range ctx.CNode {
-				if isNthLastOfType(n, arg.Dimension, ctx.CType) {
-					nodes = appendNode(nodes, n)
-				}
-			}
-		}
-	case 2:
-		if isNeg {
-			for _, n := range ctx.CNode {
-				if !isNLastOfType(n, arg.Number.Value, ctx.CType) {
-					nodes = appendNode(nodes, n)
-				}
-			}
-		} else {
-			for _, n := range ctx.CNode {
-				if isNLastOfType(n, arg.Number.Value, ctx.CType) {
-					nodes = appendNode(nodes, n)
-				}
-			}
-		}
-	case 4:
-		switch arg.Ident.Value {
-		case "even":
-			if isNeg {
-				for _, n := range ctx.CNode {
-					if !isEvenNthLastOfType(n, ctx.CType) {
-						nodes = appendNode(nodes, n)
-					}
-				}
-			} else {
-				for _, n := range ctx.CNode {
-					if isEvenNthLastOfType(n, ctx.CType) {
-						nodes = appendNode(nodes, n)
-					}
-				}
-			}
-		case "odd":
-			if isNeg {
-				for _, n := range ctx.CNode {
-					if !isOddNthLastOfType(n, ctx.CType) {
-						nodes = appendNode(nodes, n)
-					}
-				}
-			} else {
-				for _, n := range ctx.CNode {
-					if isOddNthLastOfType(n, ctx.CType) {
-						nodes = appendNode(nodes, n)
-					}
-				}
-			}
+	a, b := nthValues(arg)
+	for _, n := range ctx.CNode {
+		i := nthIndex(n, fromLast, ofType)
+		if ok := i > 0 && isNth(i, a, b); ok != isNeg {
+			nodes = append(nodes, n)
 		}
 	}
 
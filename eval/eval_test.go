@@ -1,11 +1,28 @@
 package eval
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/zzossig/carrot/ast"
 	"github.com/zzossig/carrot/lexer"
 	"github.com/zzossig/carrot/parser"
 	"golang.org/x/net/html"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/unicode"
 )
 
 func TestCarrot(t *testing.T) {
@@ -253,8 +270,8 @@ func TestCarrot(t *testing.T) {
 	}
 
 	e43 := testEval("p:nth-child( -n+ 6)")
-	if len(e43) != 8 {
-		t.Errorf("wrong number of items. got=%d, expected=8", len(e43))
+	if len(e43) != 10 {
+		t.Errorf("wrong number of items. got=%d, expected=10", len(e43))
 	}
 
 	e44 := testEval("p:nth-last-child(-n+2)")
@@ -481,6 +498,1039 @@ func TestCarrot(t *testing.T) {
 	}
 }
 
+func TestHas(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int
+	}{
+		{"div:has(p.foo)", 4},
+		{"div:has(> p.foo)", 1},
+		{".depth:has(> p.foobar)", 1},
+		{"div:has(+ p)", 2},
+		{"div:has(~ p)", 5},
+		{"div:has(~ h1)", 0},
+		{"body:has(h1, h7)", 1},
+		{"body:has(h7, h8)", 0},
+		{"p:has(span)", 5},
+		{"p:has(> span[hello])", 2},
+		{"p:has(span.example, span[goodbye])", 2},
+		{"div:has(> div > div > p.foo)", 1},
+		{"div:has(div p.foo)", 3},
+		{"div:has(> *)", 4},
+		{"div:has(> * > p.foo)", 1},
+		{"div:has(:first-child)", 4},
+		{"div:has(+ div, > p.foo)", 4},
+	}
+
+	for _, tt := range tests {
+		e := testEval(tt.input)
+		if len(e) != tt.expected {
+			t.Errorf("%s: wrong number of items. got=%d, expected=%d", tt.input, len(e), tt.expected)
+		}
+	}
+}
+
+func TestIs(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int
+	}{
+		{":is(h1, h2, h3)", 3},
+		{":where(h1, h2, h3)", 3},
+		{"body > :is(h1, h2) + p", 2},
+		{"p:is(.foo, .bar)", 3},
+		{"span:is(p > *)", 5},
+		{"p:is(div div p)", 4},
+		{":is(#d, #e) > p", 3},
+		{":is(div > p.foo, body > p.foo)", 2},
+		{"div:is(:has(> p.foo), #a)", 2},
+		{"p:is()", 0},
+		{"h1:is(h1, $)", 1},
+		{":is(h1, h2):where(h2, h3)", 1},
+		{":is(.depth .depth) p", 4},
+	}
+
+	for _, tt := range tests {
+		e := testEval(tt.input)
+		if len(e) != tt.expected {
+			t.Errorf("%s: wrong number of items. got=%d, expected=%d", tt.input, len(e), tt.expected)
+		}
+	}
+}
+
+func TestNot(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int
+	}{
+		{"p:not(.foo)", 15},
+		{"p:not(.foo, .bar)", 14},
+		{"p:not(p.foo)", 15},
+		{"p:not(p:first-child)", 13},
+		{"p:not(div p)", 11},
+		{"p:not(.depth > p)", 11},
+		{"body > p:not(div + p, h1 ~ p)", 0},
+		{"body > p:not(div + p, h2 ~ p)", 3},
+		{"p:not(div div p, .foo, .foobar)", 11},
+		{"div:not(#a, #b)", 5},
+		{"div:not(:has(p))", 3},
+		{"div:not(:is(#a, #b))", 5},
+		{"p:not(:not(.foo))", 2},
+		{"*:not(*)", 0},
+	}
+
+	for _, tt := range tests {
+		e := testEval(tt.input)
+		if len(e) != tt.expected {
+			t.Errorf("%s: wrong number of items. got=%d, expected=%d", tt.input, len(e), tt.expected)
+		}
+	}
+}
+
+func TestAttribModifier(t *testing.T) {
+	doc := `
+		<form method="POST">
+			<input type="SUBMIT" name="Go" data-x="Foo Bar">
+			<input type="submit" name="go" data-x="foo-bar">
+			<input TYPE="Text" name="GO" data-x="FOO">
+			<a href="/A" hreflang="EN-us" disabled>a</a>
+			<svg><rect type="Rect"></rect></svg>
+		</form>`
+
+	tests := []struct {
+		input    string
+		expected int
+	}{
+		{`[type="submit"]`, 2},
+		{`[type="submit" s]`, 1},
+		{`[type="SUBMIT" s]`, 1},
+		{`[type="submit" i]`, 2},
+		{`[type=submit I]`, 2},
+		{`[name="go"]`, 1},
+		{`[name="go" i]`, 3},
+		{`[name^="g" i]`, 3},
+		{`[name$=O]`, 1},
+		{`[name*="o" i]`, 3},
+		{`[data-x~="bar" i]`, 1},
+		{`[data-x|="foo" i]`, 2},
+		{`[data-x|="foo"]`, 1},
+		{`[hreflang|=en]`, 1},
+		{`[href="/a"]`, 0},
+		{`[href="/a" i]`, 1},
+		{`form[method=post]`, 1},
+		{`[TYPE]`, 3},
+		{`a[DISABLED]`, 1},
+		{`[type=rect]`, 0},
+		{`[type=rect i]`, 1},
+		{`[name^=""]`, 0},
+		{`[name$=""]`, 0},
+		{`[name*=""]`, 0},
+		{`[data-x~="foo bar" i]`, 0},
+	}
+
+	ctx := NewContext()
+	ctx.SetDocS(doc)
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := parser.New(l)
+		e := p.ParseExpression()
+		if len(p.Errors()) > 0 {
+			t.Errorf("%s: unexpected errors: %v", tt.input, p.Errors())
+			continue
+		}
+
+		nodes := Eval(e, ctx)
+		if len(nodes) != tt.expected {
+			t.Errorf("%s: wrong number of items. got=%d, expected=%d", tt.input, len(nodes), tt.expected)
+		}
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	doc := `
+		<div>
+			<a href="/html">html</a>
+			<svg viewBox="0 0 10 10">
+				<rect width="5"></rect>
+				<foreignObject><div>in svg</div></foreignObject>
+				<a xlink:href="/svg" href="/svg2"><text>svg</text></a>
+			</svg>
+			<math><mi>x</mi></math>
+		</div>`
+
+	tests := []struct {
+		input    string
+		expected int
+	}{
+		{"svg|rect", 1},
+		{"svg|*", 5},
+		{"*|*", 13},
+		{"|a", 0},
+		{"a", 2},
+		{"html|a", 1},
+		{"svg|a", 1},
+		{"math|*", 2},
+		{"math|mi", 1},
+		{"svg|foreignObject > div", 1},
+		{"svg|foreignobject", 0},
+		{"DIV", 2},
+		{"html|div", 2},
+		{"[xlink|href]", 1},
+		{"[*|href]", 2},
+		{"[href]", 2},
+		{"[|href]", 2},
+		{"[xlink|href='/svg']", 1},
+		{"a[xml|href]", 0},
+		{"foo|a", 0},
+		{"svg|svg:has(> svg|rect)", 1},
+		{":not(svg|*)", 8},
+		{"[viewBox]", 1},
+		{"[viewbox]", 0},
+	}
+
+	ctx := NewContext()
+	ctx.SetDocS(doc)
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := parser.New(l)
+		e := p.ParseExpression()
+		if len(p.Errors()) > 0 {
+			t.Errorf("%s: unexpected errors: %v", tt.input, p.Errors())
+			continue
+		}
+
+		nodes := Eval(e, ctx)
+		if len(nodes) != tt.expected {
+			t.Errorf("%s: wrong number of items. got=%d, expected=%d", tt.input, len(nodes), tt.expected)
+		}
+	}
+
+	ctx.SetNamespace("s", NamespaceSVG)
+	ctx.SetNamespace("", NamespaceSVG)
+	tests = []struct {
+		input    string
+		expected int
+	}{
+		{"s|rect", 1},
+		{"a", 1},
+		{"*", 5},
+		{"html|a", 1},
+		{"*|a", 2},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := parser.New(l)
+		nodes := Eval(p.ParseExpression(), ctx)
+		if len(nodes) != tt.expected {
+			t.Errorf("%s: wrong number of items. got=%d, expected=%d", tt.input, len(nodes), tt.expected)
+		}
+	}
+}
+
+func TestOfType(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int
+	}{
+		{":root", 1},
+		{"*:root", 1},
+		{"body:root", 0},
+		{"body :not(:root)", 35},
+		{".depth:first-of-type", 3},
+		{"body > :first-of-type", 8},
+		{"body > :last-of-type", 8},
+		{"body > :only-of-type", 6},
+		{"body > :nth-of-type(2)", 2},
+	}
+
+	for _, tt := range tests {
+		e := testEval(tt.input)
+		if len(e) != tt.expected {
+			t.Errorf("%s: wrong number of items. got=%d, expected=%d", tt.input, len(e), tt.expected)
+		}
+	}
+}
+
+func TestEscapes(t *testing.T) {
+	doc := `
+		<div class="sm:p-4 w-1/2" id="123">
+			<p class="日本">a</p>
+			<p data-x="it's" class="a:b">b</p>
+		</div>`
+
+	tests := []struct {
+		input    string
+		expected int
+	}{
+		{`.日本`, 1},
+		{`#\31 23`, 1},
+		{`#\31 23 > p`, 2},
+		{`.a\:b`, 1},
+		{`.sm\:p-4.w-1\/2`, 1},
+		{`[data-x="it's"]`, 1},
+		{`[class="sm:p-4 w-1/2"]`, 1},
+		{`/* paragraphs */ p/* with a class */.a\:b`, 1},
+		{`div /* descendant */ .a\:b`, 1},
+	}
+
+	ctx := NewContext()
+	ctx.SetDocS(doc)
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := parser.New(l)
+		e := p.ParseExpression()
+		if len(p.Errors()) > 0 {
+			t.Errorf("%s: unexpected errors: %v", tt.input, p.Errors())
+			continue
+		}
+
+		nodes := Eval(e, ctx)
+		if len(nodes) != tt.expected {
+			t.Errorf("%s: wrong number of items. got=%d, expected=%d", tt.input, len(nodes), tt.expected)
+		}
+	}
+}
+
+func TestNthOf(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int
+	}{
+		{":nth-child(2 of p)", 3},
+		{"p:nth-child(odd of .foo-bar, .bar-foo)", 2},
+		{":nth-last-child(1 of p)", 5},
+		{":nth-child(2n of .depth)", 0},
+		{"div:nth-child(-n+2 of div)", 5},
+		{"p:not(:nth-child(2 of p))", 14},
+		{"body > :nth-child(even of p:not(.foo-bar))", 4},
+	}
+
+	for _, tt := range tests {
+		e := testEval(tt.input)
+		if len(e) != tt.expected {
+			t.Errorf("%s: wrong number of items. got=%d, expected=%d", tt.input, len(e), tt.expected)
+		}
+	}
+
+	// of * counts every sibling, so it selects the same nodes as the plain form
+	for _, anb := range []string{"-n+3", "-n+6", "-2n+5", "3n-2", "n+4", "0n+2", "odd", "even", "-n"} {
+		for _, fn := range []string{"nth-child", "nth-last-child"} {
+			plain := fmt.Sprintf("p:%s(%s)", fn, anb)
+			of := fmt.Sprintf("p:%s(%s of *)", fn, anb)
+			if e1, e2 := testEval(plain), testEval(of); !reflect.DeepEqual(e1, e2) {
+				t.Errorf("%s selected %d items, %s selected %d", plain, len(e1), of, len(e2))
+			}
+		}
+	}
+}
+
+func TestConcurrentEval(t *testing.T) {
+	ctx := NewContext()
+	ctx.SetDoc("./testdata/t.html")
+	cnode := ctx.CNode
+
+	tests := []struct {
+		input    string
+		expected int
+	}{
+		{"h1,h2,h3", 3},
+		{"div[id='e'] > p", 1},
+		{"body > p:not(:first-of-type):not(:last-of-type)", 9},
+		{"div:has(> * > p.foo)", 1},
+		{"p:nth-child(2n+1)", 8},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		for _, tt := range tests {
+			wg.Add(1)
+			go func(input string, expected int) {
+				defer wg.Done()
+
+				l := lexer.New(input)
+				p := parser.New(l)
+				e := Eval(p.ParseExpression(), ctx)
+				if len(e) != expected {
+					t.Errorf("%s: wrong number of items. got=%d, expected=%d", input, len(e), expected)
+				}
+			}(tt.input, tt.expected)
+		}
+	}
+	wg.Wait()
+
+	if len(ctx.CNode) != len(cnode) || &ctx.CNode[0] != &cnode[0] {
+		t.Errorf("Eval should not modify the context")
+	}
+}
+
+func TestSetDocContext(t *testing.T) {
+	var mu sync.Mutex
+	var gotUA, gotHeader string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			mu.Lock()
+			gotUA = r.Header.Get("User-Agent")
+			gotHeader = r.Header.Get("X-Test")
+			mu.Unlock()
+			fmt.Fprint(w, "<p>a</p><p>b</p>")
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+			fmt.Fprint(w, "<p>slow</p>")
+		case "/large":
+			fmt.Fprint(w, strings.Repeat("<p>large</p>", 100))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	ctx := NewContext()
+	opts := &LoadOptions{
+		Client:    ts.Client(),
+		Header:    http.Header{"X-Test": {"yes"}},
+		UserAgent: "carrot-test",
+	}
+	if err := ctx.SetDocContext(context.Background(), ts.URL+"/ok", opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mu.Lock()
+	if gotUA != "carrot-test" || gotHeader != "yes" {
+		t.Errorf("wrong request headers. User-Agent=%q, X-Test=%q", gotUA, gotHeader)
+	}
+	mu.Unlock()
+	if n := len(Eval(testParse("p"), ctx)); n != 2 {
+		t.Errorf("wrong number of items. got=%d, expected=2", n)
+	}
+
+	tests := []struct {
+		input string
+		opts  *LoadOptions
+		err   error
+	}{
+		{ts.URL + "/missing", nil, nil},
+		{ts.URL + "/slow", &LoadOptions{Timeout: 50 * time.Millisecond}, context.DeadlineExceeded},
+		{ts.URL + "/large", &LoadOptions{MaxSize: 100}, ErrTooLarge},
+		{"./testdata/t.html", &LoadOptions{MaxSize: 100}, ErrTooLarge},
+		{"./testdata/missing.html", nil, os.ErrNotExist},
+		{"ftp://example.com/t.html", nil, nil},
+	}
+
+	for _, tt := range tests {
+		err := ctx.SetDocContext(context.Background(), tt.input, tt.opts)
+		if err == nil {
+			t.Errorf("%s: expected an error", tt.input)
+			continue
+		}
+		if tt.err != nil && !errors.Is(err, tt.err) {
+			t.Errorf("%s: wrong error. got=%v, expected=%v", tt.input, err, tt.err)
+		}
+	}
+
+	// a failed load keeps the previous document
+	if n := len(Eval(testParse("p"), ctx)); n != 2 {
+		t.Errorf("wrong number of items. got=%d, expected=2", n)
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := ctx.SetDocContext(canceled, ts.URL+"/ok", nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("wrong error. got=%v, expected=%v", err, context.Canceled)
+	}
+
+	abs, err := filepath.Abs("./testdata/t.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.SetDocContext(context.Background(), "file://"+filepath.ToSlash(abs), nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if n := len(Eval(testParse("p"), ctx)); n != 17 {
+		t.Errorf("wrong number of items. got=%d, expected=17", n)
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	encode := func(e encoding.Encoding, s string) string {
+		b, err := e.NewEncoder().String(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	sjis := encode(japanese.ShiftJIS, "<p>日本語</p>")
+	euckr := encode(korean.EUCKR, `<meta charset="euc-kr"><p>한국어</p>`)
+	cp1252 := encode(charmap.Windows1252, `<meta http-equiv="Content-Type" content="text/html; charset=windows-1252"><p>café</p>`)
+	utf16 := "\xff\xfe" + encode(unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM), "<p>utf-16</p>")
+	// the non-ASCII text comes after the first 1024 bytes the encoding is guessed from
+	utf8Doc := "<title>" + strings.Repeat("a", 2000) + "</title><p>日本語 café</p>"
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sjis":
+			w.Header().Set("Content-Type", "text/html; charset=Shift_JIS")
+			fmt.Fprint(w, sjis)
+		case "/euckr":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, euckr)
+		case "/utf16":
+			fmt.Fprint(w, utf16)
+		case "/bom":
+			fmt.Fprint(w, "\xef\xbb\xbf<p>bom</p>")
+		case "/utf8":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, utf8Doc)
+		}
+	}))
+	defer ts.Close()
+
+	text := func(ctx *Context) string {
+		// the byte order mark must not end up in the document
+		nodes := Eval(testParse("body > p:first-child"), ctx)
+		if len(nodes) != 1 || nodes[0].PrevSibling != nil || nodes[0].FirstChild == nil {
+			return ""
+		}
+		return nodes[0].FirstChild.Data
+	}
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{ts.URL + "/sjis", "日本語"},
+		{ts.URL + "/euckr", "한국어"},
+		{ts.URL + "/utf16", "utf-16"},
+		{ts.URL + "/bom", "bom"},
+		{ts.URL + "/utf8", "日本語 café"},
+	}
+
+	for _, tt := range tests {
+		ctx := NewContext()
+		if err := ctx.SetDoc(tt.input); err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.input, err)
+			continue
+		}
+		if actual := text(ctx); actual != tt.expected {
+			t.Errorf("%s: expected=%q, got=%q", tt.input, tt.expected, actual)
+		}
+	}
+
+	ctx := NewContext()
+	if err := ctx.SetDocS(cp1252); err != nil {
+		t.Fatal(err)
+	}
+	if actual := text(ctx); actual != "café" {
+		t.Errorf("windows-1252: expected=%q, got=%q", "café", actual)
+	}
+
+	resp, err := http.Get(ts.URL + "/sjis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.SetDocR(resp); err != nil {
+		t.Fatal(err)
+	}
+	if actual := text(ctx); actual != "日本語" {
+		t.Errorf("SetDocR: expected=%q, got=%q", "日本語", actual)
+	}
+
+	file := filepath.Join(t.TempDir(), "utf8.html")
+	if err := os.WriteFile(file, []byte(utf8Doc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.SetDoc(file); err != nil {
+		t.Fatal(err)
+	}
+	if actual := text(ctx); actual != "日本語 café" {
+		t.Errorf("utf-8 file: expected=%q, got=%q", "日本語 café", actual)
+	}
+
+	if err := ctx.SetDocS("\ufeff<p>bom</p>"); err != nil {
+		t.Fatal(err)
+	}
+	if actual := text(ctx); actual != "bom" {
+		t.Errorf("SetDocS bom: expected=%q, got=%q", "bom", actual)
+	}
+
+	// valid UTF-8 is not affected by a wrong meta charset
+	if err := ctx.SetDocS(`<meta charset="euc-kr"><p>日本語</p>`); err != nil {
+		t.Fatal(err)
+	}
+	if actual := text(ctx); actual != "日本語" {
+		t.Errorf("utf-8: expected=%q, got=%q", "日本語", actual)
+	}
+
+	// a forced encoding wins over the declared one
+	if err := ctx.SetEncoding("shift_jis"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.SetDocS(encode(japanese.ShiftJIS, `<meta charset="euc-kr"><p>日本語</p>`)); err != nil {
+		t.Fatal(err)
+	}
+	if actual := text(ctx); actual != "日本語" {
+		t.Errorf("forced: expected=%q, got=%q", "日本語", actual)
+	}
+
+	if err := ctx.SetEncoding("no-such-encoding"); err == nil {
+		t.Errorf("SetEncoding should return an error")
+	}
+}
+
+func TestIndex(t *testing.T) {
+	tests := []string{
+		"#a",
+		"#b div",
+		"#none",
+		".depth",
+		".foo-bar, .bar-foo",
+		"p",
+		"P",
+		"div p",
+		"div .foo",
+		"body div#g p",
+		"div p span",
+		".depth > p",
+		"div #f .foobar",
+		"div *",
+		"*",
+		"p:is(.foo)",
+		"div:has(p.foo)",
+		"p:not(div p)",
+		":nth-child(2 of p)",
+	}
+
+	ctx := NewContext()
+	ctx.SetDoc("./testdata/t.html")
+	// a context without an index takes the slow paths
+	plain := &Context{Doc: ctx.Doc, Nodes: ctx.Nodes, CNode: ctx.Nodes}
+
+	for _, tt := range tests {
+		expected := Eval(testParse(tt), plain)
+		actual := Eval(testParse(tt), ctx)
+		if len(actual) != len(expected) {
+			t.Errorf("%s: wrong number of items. got=%d, expected=%d", tt, len(actual), len(expected))
+			continue
+		}
+		for i := range actual {
+			if actual[i] != expected[i] {
+				t.Errorf("%s: wrong item at %d", tt, i)
+				break
+			}
+		}
+	}
+
+	// results must not share the index
+	nodes := Eval(testParse(".depth"), ctx)
+	nodes[0] = nil
+	if n := Eval(testParse(".depth"), ctx); n[0] == nil {
+		t.Errorf("modifying a result changed the index")
+	}
+	nodes = Eval(testParse("*"), ctx)
+	nodes[0] = nil
+	if ctx.Nodes[0] == nil {
+		t.Errorf("modifying a result changed the context")
+	}
+}
+
+func BenchmarkIndex(b *testing.B) {
+	var sb strings.Builder
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&sb, `<div class="item i%d"><p id="p%d">a <span>b</span></p></div>`, i, i)
+	}
+	ctx := NewContext()
+	ctx.SetDocS(sb.String())
+	plain := &Context{Doc: ctx.Doc, Nodes: ctx.Nodes, CNode: ctx.Nodes}
+
+	for _, sel := range []string{"#p1500", ".i1500 span", "div p#p1500"} {
+		expr := testParse(sel)
+		b.Run(sel+"/index", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				Eval(expr, ctx)
+			}
+		})
+		b.Run(sel+"/scan", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				Eval(expr, plain)
+			}
+		})
+	}
+}
+
+func TestDocumentOrder(t *testing.T) {
+	tests := []string{
+		"div > *",
+		"div *",
+		"div p",
+		"div ~ *",
+		"p + *",
+		"* + p",
+		"div:has(p) p",
+		"body > div p ~ p",
+		"#d *, #e *",
+	}
+
+	ctx := NewContext()
+	ctx.SetDoc("./testdata/t.html")
+	order := make(map[*html.Node]int)
+	for i, n := range ctx.Nodes {
+		order[n] = i
+	}
+
+	// the order is looked up in the index, or worked out from the tree without it
+	plain := &Context{Doc: ctx.Doc, Nodes: ctx.Nodes, CNode: ctx.Nodes}
+
+	for _, tt := range tests {
+		for _, c := range []*Context{ctx, plain} {
+			nodes := Eval(testParse(tt), c)
+			if len(nodes) == 0 {
+				t.Errorf("%s: no items", tt)
+			}
+			for i := 1; i < len(nodes); i++ {
+				if order[nodes[i-1]] >= order[nodes[i]] {
+					t.Errorf("%s: items %d and %d are not in document order", tt, i-1, i)
+					break
+				}
+			}
+		}
+	}
+
+	// sorting alone does not build the index
+	cnode := append([]*html.Node(nil), ctx.Nodes...)
+	fresh := &Context{Doc: ctx.Doc, Nodes: ctx.Nodes, CNode: cnode, index: &docIndex{}}
+	nodes := Eval(testParse(":last-child, :first-child"), fresh)
+	for i := 1; i < len(nodes); i++ {
+		if order[nodes[i-1]] >= order[nodes[i]] {
+			t.Errorf("items %d and %d are not in document order", i-1, i)
+			break
+		}
+	}
+	if fresh.builtIndex() != nil {
+		t.Errorf("sorting the nodes built the index")
+	}
+
+	// walking the tree agrees with the positions in the index
+	for i, a := range ctx.Nodes {
+		for j, b := range ctx.Nodes {
+			if precedes(a, b) != (i < j) {
+				t.Fatalf("precedes(%s, %s) should be %t", a.Data, b.Data, i < j)
+			}
+		}
+		if !precedes(ctx.Doc, a) || precedes(a, ctx.Doc) {
+			t.Fatalf("the document should precede %s", a.Data)
+		}
+	}
+
+	// a large unsorted set is sorted with the index
+	ctx = NewContext()
+	ctx.SetDocS(strings.Repeat("<p><span>a</span></p>", sortIndexThreshold))
+	large := &Context{Doc: ctx.Doc, Nodes: ctx.Nodes, CNode: ctx.Nodes, index: &docIndex{}}
+	nodes = make([]*html.Node, len(ctx.Nodes))
+	for i, n := range ctx.Nodes {
+		nodes[len(nodes)-1-i] = n
+	}
+	sortNodes(nodes, large)
+	for i, n := range nodes {
+		if n != ctx.Nodes[i] {
+			t.Fatalf("item %d is not in document order", i)
+		}
+	}
+	if large.builtIndex() == nil {
+		t.Errorf("sorting a large set did not build the index")
+	}
+
+	// SelectorOrder returns the nodes of each selector in turn
+	sctx := NewContext()
+	sctx.SetDoc("./testdata/t.html")
+	sctx.SetOrder(SelectorOrder)
+	nodes = Eval(testParse("p.foo, h1, p"), sctx)
+	if len(nodes) != 18 {
+		t.Fatalf("wrong number of items. got=%d, expected=18", len(nodes))
+	}
+	if !hasClass(nodes[0], "foo") || !hasClass(nodes[1], "foo") || nodes[2].Data != "h1" || nodes[3].Data != "p" {
+		t.Errorf("items are not in selector order")
+	}
+}
+
+func TestEvalDirections(t *testing.T) {
+	tests := []string{
+		"*",
+		"body > p",
+		"div p ~ p",
+		"p + p, h1",
+		"body *:not(h1,h2,h3,h4,h5,h6)",
+		"div:has(> p) p:nth-child(2n+1)",
+		":is(#d, #e) > :last-child",
+		"p:nth-last-child(odd of .foo)",
+		"html:root, :scope > body",
+		"> body",
+	}
+
+	ctx := NewContext()
+	ctx.SetDoc("./testdata/t.html")
+	// Eval matches right to left from the whole document,
+	// and follows the combinators left to right from a copy of it
+	ltr := &Context{Doc: ctx.Doc, Nodes: ctx.Nodes, CNode: append([]*html.Node(nil), ctx.Nodes...)}
+
+	for _, tt := range tests {
+		expr := testParse(tt)
+		for _, order := range []Order{DocumentOrder, SelectorOrder} {
+			ctx.SetOrder(order)
+			ltr.SetOrder(order)
+			rl, lr := Eval(expr, ctx), Eval(expr, ltr)
+			if len(rl) == 0 || !reflect.DeepEqual(rl, lr) {
+				t.Errorf("%s: the directions disagree. got=%d and %d items", tt, len(rl), len(lr))
+			}
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []string{
+		"*",
+		"p",
+		"#a",
+		".depth",
+		"div p",
+		"div > p",
+		"div div div p",
+		"body > div p ~ p",
+		"h1 ~ p",
+		"h2 + p",
+		"p + *",
+		"div > * + p",
+		".depth > p:first-child",
+		"p:not(.foo)",
+		"p:not(div p)",
+		"p:not(.depth > p, h2 ~ p)",
+		"div:not(#a, #b)",
+		":is(h1, h2) + p",
+		"div:where(.depth) > p",
+		"div:has(> p.foo)",
+		"div:has(+ p)",
+		":nth-child(2 of p)",
+		"p:nth-last-child(odd of p)",
+		":nth-child(2n+1)",
+		"p:nth-of-type(2)",
+		"body > :last-of-type",
+		":root",
+		"span[hello]",
+		"[class~=foo]",
+		"p:empty",
+		"div p, h1",
+	}
+
+	ctx := NewContext()
+	ctx.SetDoc("./testdata/t.html")
+	sub := NewContext()
+	sub.SetDocN(Eval(testParse("#d"), ctx)[0])
+
+	for _, c := range []*Context{ctx, sub} {
+		for _, tt := range tests {
+			expr := testParse(tt)
+			expected := Eval(expr, c)
+
+			actual := Match(expr, c)
+			if len(actual) != len(expected) {
+				t.Errorf("%s: wrong number of items. got=%d, expected=%d", tt, len(actual), len(expected))
+				continue
+			}
+			for i := range actual {
+				if actual[i] != expected[i] {
+					t.Errorf("%s: wrong item at %d", tt, i)
+					break
+				}
+			}
+
+			m := Compile(expr, c)
+			for _, n := range expected {
+				if !m(n) {
+					t.Errorf("%s: matcher does not match %s", tt, n.Data)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int
+	}{
+		{"p", 4},
+		{"body p", 4},
+		{"#d p", 4},
+		{"div > p", 4},
+		{"#d > p", 0},
+		{":scope", 0},
+		{":scope p", 4},
+		{":scope > p", 1},
+		{"div:not(:scope) > p", 3},
+		{"> p", 1},
+		{"> div > p", 1},
+		{"> div p, > p", 4},
+		{"+ p", 0},
+		{"~ *", 0},
+		{"p:first-child", 3},
+		{"div:has(> .foo) > p", 2},
+	}
+
+	ctx := NewContext()
+	ctx.SetDoc("./testdata/t.html")
+	root := Eval(testParse("#e"), ctx)[0]
+
+	for _, tt := range tests {
+		nodes := Find(root, testParse(tt.input), ctx)
+		if len(nodes) != tt.expected {
+			t.Errorf("%s: wrong number of items. got=%d, expected=%d", tt.input, len(nodes), tt.expected)
+		}
+		for _, n := range nodes {
+			if !isAncestor(root, n) {
+				t.Errorf("%s: %s is not a descendant of the root", tt.input, n.Data)
+			}
+		}
+	}
+
+	// without Find, :scope is :root and relative selectors start from it
+	for input, expected := range map[string]int{":scope": 1, "> body": 1, "> * > h1": 1, ":scope > p": 0} {
+		if nodes := Eval(testParse(input), ctx); len(nodes) != expected {
+			t.Errorf("%s: wrong number of items. got=%d, expected=%d", input, len(nodes), expected)
+		}
+	}
+
+	// a group follows the order of the context
+	ctx.SetOrder(SelectorOrder)
+	nodes := Find(root, testParse("#g > p, > p"), ctx)
+	if len(nodes) != 3 || !isAncestor(Eval(testParse("#g"), ctx)[0], nodes[0]) || nodes[2].Parent != root {
+		t.Errorf("items are not in selector order")
+	}
+}
+
+func TestClosest(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string // id of the closest element, or its tag name
+	}{
+		{"p", "p"},
+		{".depth", "g"},
+		{"#d", "d"},
+		{"body > div", "d"},
+		{"div:has(> div > div)", "e"},
+		{":root", "html"},
+		{"table", ""},
+		{":scope", "p"},
+		{"#g > :scope", "p"},
+		{":scope > span", ""},
+		{":not(:scope)", "g"},
+	}
+
+	ctx := NewContext()
+	ctx.SetDoc("./testdata/t.html")
+	n := Eval(testParse("#g > .foo"), ctx)[0]
+
+	for _, tt := range tests {
+		c := Closest(n, testParse(tt.input), ctx)
+		got := ""
+		if c != nil {
+			got = c.Data
+			for _, a := range c.Attr {
+				if a.Key == "id" {
+					got = a.Val
+				}
+			}
+		}
+		if got != tt.expected {
+			t.Errorf("%s: wrong element. got=%q, expected=%q", tt.input, got, tt.expected)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	ctx := NewContext()
+	ctx.SetDoc("./testdata/t.html")
+
+	tests := []string{
+		"div > p",
+		"div:has(> p.foo) ~ p, h1",
+		"> body h1:not(.x)",
+		"p:nth-child(2 of .foo-bar)",
+	}
+	for _, tt := range tests {
+		nodes, tr := Explain(testParse(tt), ctx)
+		expected := Eval(testParse(tt), ctx)
+		if len(nodes) != len(expected) {
+			t.Errorf("%s: wrong number of items. got=%d, expected=%d", tt, len(nodes), len(expected))
+		}
+		if tr.Expr.String() != testParse(tt).String() || tr.Out != len(nodes) || tr.Calls != 1 {
+			t.Errorf("%s: wrong root trace %+v", tt, tr)
+		}
+	}
+	if ctx.tracer != nil {
+		t.Errorf("Explain should not modify the context")
+	}
+
+	_, tr := Explain(testParse("div:has(> p.foo) ~ p, h1"), ctx)
+	expected := `Group "div:has(> p.foo) ~ p, h1" 39 -> 1 [h1]
+  Selector "div:has(> p.foo) ~ p" 39 -> 0
+    Sequence "div:has(> p.foo)" 39 -> 1 [div#g.depth]
+      Ident "div" 39 -> 7 [div#a, div#b, div#c, ...]
+      Has ":has(> p.foo)" 7 -> 1 [div#g.depth]
+        child combinator from the anchor 7 -> 9 in 7 calls [p, div#e.depth, p.p.q.r, ...]
+        Sequence "p.foo" 9 -> 1 in 7 calls [p.foo]
+          Ident "p" 9 -> 6 in 7 calls [p, p.p.q.r, p, ...]
+          Class ".foo" 6 -> 1 in 7 calls [p.foo]
+    subsequent-sibling combinator 1 -> 0
+    Sequence "p" 0 -> 0
+      Ident "p" 0 -> 0
+  Sequence "h1" 39 -> 1 [h1]
+    Ident "h1" 39 -> 1 [h1]
+`
+	if tr.String() != expected {
+		t.Errorf("wrong trace.\ngot:\n%s\nexpected:\n%s", tr, expected)
+	}
+}
+
+func BenchmarkMatch(b *testing.B) {
+	var sb strings.Builder
+	for i := 0; i < 200; i++ {
+		sb.WriteString(strings.Repeat("<div>", 8))
+		sb.WriteString(`<p class="x">a</p><a href="#">b</a><p class="y">c</p>`)
+		sb.WriteString(strings.Repeat("</div>", 8))
+	}
+	ctx := NewContext()
+	ctx.SetDocS(sb.String())
+	// starting from a copy of the elements, Eval follows the combinators left to right
+	ltr := &Context{Doc: ctx.Doc, Nodes: ctx.Nodes, CNode: append([]*html.Node(nil), ctx.Nodes...)}
+
+	for _, sel := range []string{"div div div a", "div p", ".x ~ .y", "div > div > a", "div:has(> a) p"} {
+		expr := testParse(sel)
+		b.Run(sel+"/eval", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				Eval(expr, ctx)
+			}
+		})
+		b.Run(sel+"/ltr", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				Eval(expr, ltr)
+			}
+		})
+		b.Run(sel+"/match", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				Match(expr, ctx)
+			}
+		})
+	}
+}
+
+func testParse(input string) ast.Expression {
+	return parser.New(lexer.New(input)).ParseExpression()
+}
+
 func testEval(input string) []*html.Node {
 	l := lexer.New(input)
 	p := parser.New(l)
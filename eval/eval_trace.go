@@ -0,0 +1,175 @@
+package eval
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/zzossig/carrot/ast"
+	"github.com/zzossig/carrot/token"
+	"golang.org/x/net/html"
+)
+
+// SampleSize is the number of resulting nodes a Trace keeps.
+const SampleSize = 3
+
+// Trace records a step of an evaluation: an AST node visited by Eval or a combinator
+// collecting the nodes the next sequence is matched against. Steps run more than once,
+// like the argument of :has() which is evaluated for each candidate, are merged.
+type Trace struct {
+	Expr     ast.Expression // evaluated node, nil for combinator steps
+	Label    string         // kind of the step like "Sequence" or "child combinator"
+	Calls    int            // number of times the step ran
+	In       int            // number of candidate nodes, summed over the calls
+	Out      int            // number of resulting nodes, summed over the calls
+	Sample   []*html.Node   // first resulting nodes, at most SampleSize
+	Children []*Trace
+}
+
+// Explain evaluates expr like Eval and records the evaluation as a tree of Traces.
+// The steps are evaluated from left to right, starting from ctx.CNode, even where
+// Eval matches each element right to left. It is slower than Eval and meant to
+// find the step that leaves no nodes.
+func Explain(expr ast.Expression, ctx *Context) ([]*html.Node, *Trace) {
+	q := ctx.query()
+	q.tracer = &tracer{stack: []*Trace{{}}}
+
+	nodes := Eval(expr, q)
+	return nodes, q.tracer.stack[0].Children[0]
+}
+
+// tracer builds the Trace tree while evaluating.
+type tracer struct {
+	stack []*Trace // the root and the steps being evaluated
+}
+
+// record evaluates expr as a child of the current step.
+func (t *tracer) record(expr ast.Expression, ctx *Context) []*html.Node {
+	tr := t.stack[len(t.stack)-1].child(expr, exprLabel(expr))
+	in := len(ctx.CNode)
+
+	t.stack = append(t.stack, tr)
+	nodes := evalNode(expr, ctx)
+	t.stack = t.stack[:len(t.stack)-1]
+
+	tr.add(in, nodes)
+	return nodes
+}
+
+// traceStep records a step that is not an AST node, like a combinator.
+func (c *Context) traceStep(label string, in, out []*html.Node) {
+	if c.tracer == nil {
+		return
+	}
+	t := c.tracer
+	t.stack[len(t.stack)-1].child(nil, label).add(len(in), out)
+}
+
+// child returns the child of t for expr and label, adding it if it is new.
+func (t *Trace) child(expr ast.Expression, label string) *Trace {
+	for _, c := range t.Children {
+		if c.Expr == expr && c.Label == label {
+			return c
+		}
+	}
+
+	c := &Trace{Expr: expr, Label: label}
+	t.Children = append(t.Children, c)
+	return c
+}
+
+func (t *Trace) add(in int, out []*html.Node) {
+	t.Calls++
+	t.In += in
+	t.Out += len(out)
+	for _, n := range out {
+		if len(t.Sample) == SampleSize {
+			break
+		}
+		t.Sample = append(t.Sample, n)
+	}
+}
+
+// String prints the trace as an indented tree:
+//
+//	Selector "div > p" 256 -> 6 [p, p, p.foo, ...]
+//	  Sequence "div" 256 -> 7 [div#a, div#b, div#c, ...]
+//	    Ident "div" 256 -> 7 [div#a, div#b, div#c, ...]
+//	  child combinator 7 -> 11 [p, div#e, p, ...]
+//	  Sequence "p" 11 -> 6 [p, p, p.foo, ...]
+//	    Ident "p" 11 -> 6 [p, p, p.foo, ...]
+func (t *Trace) String() string {
+	var sb strings.Builder
+	t.write(&sb, "")
+	return sb.String()
+}
+
+func (t *Trace) write(sb *strings.Builder, indent string) {
+	sb.WriteString(indent)
+	sb.WriteString(t.Label)
+	if t.Expr != nil {
+		fmt.Fprintf(sb, " %q", t.Expr.String())
+	}
+	fmt.Fprintf(sb, " %d -> %d", t.In, t.Out)
+	if t.Calls > 1 {
+		fmt.Fprintf(sb, " in %d calls", t.Calls)
+	}
+
+	if len(t.Sample) > 0 {
+		names := make([]string, len(t.Sample))
+		for i, n := range t.Sample {
+			names[i] = describeNode(n)
+		}
+		if t.Out > len(t.Sample) {
+			names = append(names, "...")
+		}
+		fmt.Fprintf(sb, " [%s]", strings.Join(names, ", "))
+	}
+	sb.WriteString("\n")
+
+	for _, c := range t.Children {
+		c.write(sb, indent+"  ")
+	}
+}
+
+// exprLabel returns the type name of expr like "Sequence".
+func exprLabel(expr ast.Expression) string {
+	t := reflect.TypeOf(expr)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+// describeNode returns a short form of n like div#main.card.
+func describeNode(n *html.Node) string {
+	var sb strings.Builder
+	sb.WriteString(n.Data)
+	for _, a := range n.Attr {
+		if a.Namespace == "" && a.Key == "id" && a.Val != "" {
+			sb.WriteString("#" + a.Val)
+		}
+	}
+	for _, a := range n.Attr {
+		if a.Namespace == "" && a.Key == "class" {
+			for _, c := range strings.Fields(a.Val) {
+				sb.WriteString("." + c)
+			}
+		}
+	}
+	return sb.String()
+}
+
+// combinatorName returns the name of a combinator in traces.
+func combinatorName(tt token.Type) string {
+	switch tt {
+	case token.TILDE:
+		return "subsequent-sibling combinator"
+	case token.PLUS:
+		return "next-sibling combinator"
+	case token.GT:
+		return "child combinator"
+	default:
+		return "descendant combinator"
+	}
+}
@@ -1,102 +1,50 @@
 package eval
 
 import (
+	"sort"
 	"strings"
 
 	"github.com/zzossig/carrot/ast"
+	"github.com/zzossig/carrot/token"
 	"golang.org/x/net/html"
 )
 
-func appendNode(src []*html.Node, target *html.Node) []*html.Node {
-	if !isContain(src, target) {
-		src = append(src, target)
-	}
-	return src
-}
-
-func isContain(src []*html.Node, target *html.Node) bool {
-	for _, item := range src {
-		if item == target {
-			return true
-		}
-	}
-	return false
-}
-
 func walkDesc(n *html.Node) []*html.Node {
-	var nodes []*html.Node
+	return appendDesc(nil, n)
+}
 
+// appendDesc appends the descendant elements of n to nodes in document order.
+func appendDesc(nodes []*html.Node, n *html.Node) []*html.Node {
 	for c := n.FirstChild; c != nil; c = c.NextSibling {
 		if c.Type == html.ElementNode {
-			nodes = appendNode(nodes, c)
-			if c.FirstChild != nil {
-				for _, d := range walkDesc(c) {
-					nodes = appendNode(nodes, d)
-				}
-			}
+			nodes = append(nodes, c)
+			nodes = appendDesc(nodes, c)
 		}
 	}
-
 	return nodes
 }
 
-func makeNegation(e ast.Expression) *ast.Negation {
-	neg := &ast.Negation{}
-	neg.NArg = &ast.NArg{}
-
-	switch e := e.(type) {
-	case *ast.Ident:
-		neg.NArg.Ident = e
-		neg.NArg.TypeID = 1
-	case *ast.Universal:
-		neg.NArg.Universal = e
-		neg.NArg.TypeID = 2
-	case *ast.Hash:
-		neg.NArg.Hash = e
-		neg.NArg.TypeID = 3
-	case *ast.Class:
-		neg.NArg.Class = e
-		neg.NArg.TypeID = 4
-	case *ast.Attrib:
-		neg.NArg.Attrib = e
-		neg.NArg.TypeID = 5
-	case *ast.Pseudo:
-		neg.NArg.Pseudo = e
-		neg.NArg.TypeID = 6
-	case *ast.Group:
-		neg.NArg.Group = e
-		neg.NArg.TypeID = 7
-	case *ast.Sequence:
-		if ident, ok := e.Expression.(*ast.Ident); ok {
-			neg.NArg.Ident = ident
-			neg.NArg.TypeID = 1
-			break
-		} else if univ, ok := e.Expression.(*ast.Universal); ok {
-			neg.NArg.Universal = univ
-			neg.NArg.TypeID = 1
-			break
-		}
-		if len(e.Exprs) != 1 {
-			return nil
-		}
-		return makeNegation(e.Exprs[0])
-	}
-
-	return neg
-}
+// The collect functions below expect ctx.CNode to be in document order
+// without duplicates, and return the nodes they collect the same way.
 
 func collectSubSibling(ctx *Context) []*html.Node {
 	var nodes []*html.Node
+	seen := make(map[*html.Node]bool)
 
 	for _, n := range ctx.CNode {
 		for s := n.NextSibling; s != nil; s = s.NextSibling {
 			if s.Type == html.ElementNode {
+				// the rest was collected from a previous sibling
+				if seen[s] {
+					break
+				}
+				seen[s] = true
 				nodes = append(nodes, s)
 			}
 		}
 	}
 
-	return nodes
+	return sortNodes(nodes, ctx)
 }
 
 func collectNextSibling(ctx *Context) []*html.Node {
@@ -111,7 +59,7 @@ func collectNextSibling(ctx *Context) []*html.Node {
 		}
 	}
 
-	return nodes
+	return sortNodes(nodes, ctx)
 }
 
 func collectChild(ctx *Context) []*html.Node {
@@ -125,394 +73,552 @@ func collectChild(ctx *Context) []*html.Node {
 		}
 	}
 
-	return nodes
+	return sortNodes(nodes, ctx)
 }
 
 func collectDesc(ctx *Context) []*html.Node {
 	var nodes []*html.Node
 
+	var last *html.Node
 	for _, n := range ctx.CNode {
-		nodes = append(nodes, walkDesc(n)...)
+		// the descendants of n were collected with those of last
+		if last != nil && isAncestor(last, n) {
+			continue
+		}
+		nodes = appendDesc(nodes, n)
+		last = n
 	}
 
 	return nodes
 }
 
-func collectDescOrSelf(ctx *Context) []*html.Node {
-	var nodes []*html.Node
-
-	for _, n := range ctx.CNode {
-		nodes = appendNode(nodes, n)
-		for _, d := range walkDesc(n) {
-			nodes = appendNode(nodes, d)
+// isAncestor reports whether a is an ancestor of n.
+func isAncestor(a, n *html.Node) bool {
+	for p := n.Parent; p != nil; p = p.Parent {
+		if p == a {
+			return true
 		}
 	}
+	return false
+}
+
+// sortIndexThreshold is the number of unsorted nodes from which sortNodes
+// builds the index rather than comparing the nodes by walking the tree.
+const sortIndexThreshold = 256
+
+// sortNodes sorts nodes in document order.
+// nodes is sorted in place, so it must not be shared.
+// The order is looked up in the index if it is already built, or if nodes
+// is large enough for building it to cost less than walking the tree.
+func sortNodes(nodes []*html.Node, ctx *Context) []*html.Node {
+	idx := ctx.builtIndex()
+	less := func(i, j int) bool {
+		return idx.precedes(nodes[i], nodes[j])
+	}
 
+	if sort.SliceIsSorted(nodes, less) {
+		return nodes
+	}
+	if idx == nil && len(nodes) >= sortIndexThreshold {
+		idx = ctx.docIndex()
+	}
+	sort.Slice(nodes, less)
 	return nodes
 }
 
-func isDashMatched(s, substr string) bool {
-	if s == substr {
-		return true
-	}
-	if strings.HasPrefix(s, substr+"-") {
-		return true
+// precedes reports whether a comes before b in document order, comparing
+// their positions in the order map. Nodes that are not in the map, such as
+// nodes of another tree, are compared by walking the tree. idx may be nil.
+func (idx *docIndex) precedes(a, b *html.Node) bool {
+	if idx != nil {
+		if i, ok := idx.order[a]; ok {
+			if j, ok := idx.order[b]; ok {
+				return i < j
+			}
+		}
 	}
-	return false
+	return precedes(a, b)
 }
 
-func isFirstChild(n *html.Node) bool {
-	if n.Parent == nil {
+// precedes reports whether a comes before b in document order.
+// It is used when the index of a Context is not built.
+func precedes(a, b *html.Node) bool {
+	if a == b {
 		return false
 	}
 
-	for c := n.Parent.FirstChild; c != nil; c = c.NextSibling {
-		if c.Type == html.ElementNode {
-			if c == n {
-				return true
-			}
-			break
-		}
+	// bring a and b up to the same depth
+	da, db := depth(a), depth(b)
+	pa, pb := a, b
+	for ; da > db; da-- {
+		pa = pa.Parent
+	}
+	for ; db > da; db-- {
+		pb = pb.Parent
+	}
+	switch {
+	case pa == b:
+		return false // b is an ancestor of a
+	case pb == a:
+		return true // a is an ancestor of b
 	}
 
+	// walk up to the children of the common ancestor
+	for pa.Parent != pb.Parent {
+		pa, pb = pa.Parent, pb.Parent
+	}
+	for s := pa.NextSibling; s != nil; s = s.NextSibling {
+		if s == pb {
+			return true
+		}
+	}
 	return false
 }
 
-func isFirstOfType(n *html.Node, t string) bool {
-	if n.Parent == nil {
-		return false
+// depth returns the number of ancestors of n.
+func depth(n *html.Node) int {
+	var d int
+	for p := n.Parent; p != nil; p = p.Parent {
+		d++
 	}
+	return d
+}
 
-	for c := n.Parent.FirstChild; c != nil; c = c.NextSibling {
-		if c.Type == html.ElementNode && c.Data == t {
-			if c == n {
-				return true
-			}
-			break
-		}
+// isRelativeMatched reports whether the relative selector e matches any element
+// relative to the anchor n. A selector without a leading combinator is relative
+// to the descendants of n.
+func isRelativeMatched(n *html.Node, e ast.Expression, ctx *Context) bool {
+	rctx := ctx.query()
+	rctx.CNode = []*html.Node{n}
+
+	tt := token.S
+	if rs, ok := e.(*ast.RSelector); ok {
+		tt = rs.Token.Type
+		e = rs.Expr
 	}
+	rctx.CNode = collectRelative(tt, rctx)
+	rctx.traceStep(combinatorName(tt)+" from the anchor", []*html.Node{n}, rctx.CNode)
 
-	return false
+	return len(evalExpr(e, rctx)) > 0
 }
 
-func isLastChild(n *html.Node) bool {
-	if n.Parent == nil {
-		return false
+// collectRelative collects the nodes related to ctx.CNode by the combinator tt.
+func collectRelative(tt token.Type, ctx *Context) []*html.Node {
+	switch tt {
+	case token.TILDE:
+		return collectSubSibling(ctx)
+	case token.PLUS:
+		return collectNextSibling(ctx)
+	case token.GT:
+		return collectChild(ctx)
+	default:
+		return collectDesc(ctx)
 	}
+}
 
-	for c := n.Parent.LastChild; c != nil; c = c.PrevSibling {
-		if c.Type == html.ElementNode {
-			if c == n {
-				return true
-			}
-			break
+// collectMatched evaluates sels against the whole document
+// and returns the set of matched nodes.
+func collectMatched(sels []ast.Expression, ctx *Context) map[*html.Node]bool {
+	matched := make(map[*html.Node]bool)
+
+	for _, sel := range sels {
+		mctx := ctx.query()
+		mctx.CNode = ctx.Nodes
+		for _, n := range evalExpr(sel, mctx) {
+			matched[n] = true
 		}
 	}
 
+	return matched
+}
+
+func isIDMatched(n *html.Node, id string) bool {
+	for _, a := range n.Attr {
+		if a.Key == "id" && a.Val == id {
+			return true
+		}
+	}
 	return false
 }
 
-func isLastOfType(n *html.Node, t string) bool {
-	if n.Parent == nil {
-		return false
+func hasClass(n *html.Node, name string) bool {
+	for _, a := range n.Attr {
+		if a.Key == "class" {
+			for _, s := range strings.Fields(a.Val) {
+				if s == name {
+					return true
+				}
+			}
+		}
 	}
+	return false
+}
 
-	for c := n.Parent.LastChild; c != nil; c = c.PrevSibling {
-		if c.Type == html.ElementNode && c.Data == t {
-			if c == n {
-				return true
+// caseInsensitiveAttrs is the list of attributes whose values are matched
+// ASCII case-insensitively on HTML elements.
+// https://html.spec.whatwg.org/multipage/semantics-other.html#case-sensitivity-of-selectors
+var caseInsensitiveAttrs = map[string]bool{
+	"accept": true, "accept-charset": true, "align": true, "alink": true,
+	"axis": true, "bgcolor": true, "charset": true, "checked": true,
+	"clear": true, "codetype": true, "color": true, "compact": true,
+	"declare": true, "defer": true, "dir": true, "direction": true,
+	"disabled": true, "enctype": true, "face": true, "frame": true,
+	"hreflang": true, "http-equiv": true, "lang": true, "language": true,
+	"link": true, "media": true, "method": true, "multiple": true,
+	"nohref": true, "noresize": true, "noshade": true, "nowrap": true,
+	"readonly": true, "rel": true, "rev": true, "rules": true,
+	"scope": true, "scrolling": true, "selected": true, "shape": true,
+	"target": true, "text": true, "type": true, "valign": true,
+	"valuetype": true, "vlink": true,
+}
+
+// isAttrMatched reports whether n has an attribute matched by ae.
+func isAttrMatched(n *html.Node, ae *ast.AttrExpr, ctx *Context) bool {
+	name := ae.Left.Value
+	if n.Namespace == "" {
+		name = toASCIILower(name)
+	}
+
+	for _, a := range n.Attr {
+		if a.Key != name || !isAttrNamespaceMatched(a, ae.Namespace, ctx) {
+			continue
+		}
+		if ae.TypeID == 1 {
+			return true
+		}
+
+		val, sub := a.Val, ae.Right.Value
+		if ae.Modifier == "i" || ae.Modifier == "" && n.Namespace == "" && caseInsensitiveAttrs[name] {
+			val, sub = toASCIILower(val), toASCIILower(sub)
+		}
+
+		switch ae.Token.Type {
+		case token.EQ:
+			return val == sub
+		case token.PREFIXMATCH:
+			return sub != "" && strings.HasPrefix(val, sub)
+		case token.SUFFIXMATCH:
+			return sub != "" && strings.HasSuffix(val, sub)
+		case token.SUBSTRINGMATCH:
+			return sub != "" && strings.Contains(val, sub)
+		case token.INCLUDES:
+			if sub == "" || strings.ContainsAny(sub, " \t\n\r\f") {
+				return false
 			}
-			break
+			for _, s := range strings.Fields(val) {
+				if s == sub {
+					return true
+				}
+			}
+			return false
+		case token.DASHMATCH:
+			return isDashMatched(val, sub)
 		}
 	}
 
 	return false
 }
 
-func isOnlyChlid(n *html.Node) bool {
-	if n.Parent == nil {
-		return false
+// isTypeMatched reports whether n is an element named name.
+// Names of html elements are matched case-insensitively.
+func isTypeMatched(n *html.Node, name string) bool {
+	if n.Data == name {
+		return true
 	}
+	return n.Namespace == "" && n.Data == toASCIILower(name)
+}
 
-	cnt := 0
-	for c := n.Parent.FirstChild; c != nil; c = c.NextSibling {
-		if c.Type == html.ElementNode {
-			cnt++
-		}
+// isNamespaceMatched reports whether n is in the namespace ns.
+// A nil ns means the default namespace if it is set, or any namespace.
+func isNamespaceMatched(n *html.Node, ns *ast.Namespace, ctx *Context) bool {
+	prefix := ""
+	if ns != nil {
+		prefix = ns.Prefix
 	}
 
-	return cnt == 1
-}
+	switch {
+	case prefix == "*":
+		return true
+	case ns != nil && prefix == "":
+		return false // every element of an html document has a namespace
+	}
 
-func isOnlyOfType(n *html.Node, t string) bool {
-	if n.Parent == nil {
-		return false
+	uri, ok := ctx.lookupNamespace(prefix)
+	if !ok {
+		return ns == nil
 	}
+	return uri == elementNamespace(n)
+}
 
-	cnt := 0
-	for c := n.Parent.FirstChild; c != nil; c = c.NextSibling {
-		if c.Type == html.ElementNode && c.Data == t {
-			cnt++
-		}
+// isAttrNamespaceMatched reports whether the attribute a is in the namespace ns.
+// A nil ns means no namespace.
+func isAttrNamespaceMatched(a html.Attribute, ns *ast.Namespace, ctx *Context) bool {
+	switch {
+	case ns == nil || ns.Prefix == "":
+		return a.Namespace == ""
+	case ns.Prefix == "*":
+		return true
 	}
 
-	return cnt == 1
+	uri, ok := ctx.lookupNamespace(ns.Prefix)
+	return ok && uri == attrNamespace(a)
 }
 
-func isNChild(n *html.Node, num int) bool {
-	if n.Parent == nil {
-		return false
+func elementNamespace(n *html.Node) string {
+	switch n.Namespace {
+	case "":
+		return NamespaceHTML
+	case "svg":
+		return NamespaceSVG
+	case "math":
+		return NamespaceMathML
 	}
+	return n.Namespace
+}
 
-	i := 0
-	for c := n.Parent.FirstChild; c != nil; c = c.NextSibling {
-		if c.Type == html.ElementNode {
-			i++
-			if i == num && n == c {
-				return true
+func attrNamespace(a html.Attribute) string {
+	switch a.Namespace {
+	case "xlink":
+		return NamespaceXLink
+	case "xml":
+		return NamespaceXML
+	case "xmlns":
+		return NamespaceXMLNS
+	}
+	return a.Namespace
+}
+
+// toASCIILower lowercases ASCII letters only, as css does for case-insensitive matching.
+func toASCIILower(s string) string {
+	for i := 0; i < len(s); i++ {
+		if 'A' <= s[i] && s[i] <= 'Z' {
+			b := []byte(s)
+			for j := i; j < len(b); j++ {
+				if 'A' <= b[j] && b[j] <= 'Z' {
+					b[j] += 'a' - 'A'
+				}
 			}
+			return string(b)
 		}
 	}
+	return s
+}
 
+func isDashMatched(s, substr string) bool {
+	if s == substr {
+		return true
+	}
+	if strings.HasPrefix(s, substr+"-") {
+		return true
+	}
 	return false
 }
 
-func isNLastChild(n *html.Node, num int) bool {
-	if n.Parent == nil {
+// isRoot reports whether n is the root element of doc.
+func isRoot(n *html.Node, doc *html.Node) bool {
+	if doc == nil {
 		return false
 	}
 
-	i := 0
-	for c := n.Parent.LastChild; c != nil; c = c.PrevSibling {
+	for c := doc.FirstChild; c != nil; c = c.NextSibling {
 		if c.Type == html.ElementNode {
-			i++
-			if i == num && n == c {
-				return true
-			}
+			return c == n
 		}
 	}
 
 	return false
 }
 
-func isNOfType(n *html.Node, num int, t string) bool {
+func isFirstChild(n *html.Node) bool {
 	if n.Parent == nil {
 		return false
 	}
 
-	i := 0
 	for c := n.Parent.FirstChild; c != nil; c = c.NextSibling {
-		if c.Type == html.ElementNode && c.Data == t {
-			i++
-			if i == num && n == c {
+		if c.Type == html.ElementNode {
+			if c == n {
 				return true
 			}
+			break
 		}
 	}
 
 	return false
 }
 
-func isNLastOfType(n *html.Node, num int, t string) bool {
+func isFirstOfType(n *html.Node, t string) bool {
 	if n.Parent == nil {
 		return false
 	}
 
-	i := 0
-	for c := n.Parent.LastChild; c != nil; c = c.PrevSibling {
+	for c := n.Parent.FirstChild; c != nil; c = c.NextSibling {
 		if c.Type == html.ElementNode && c.Data == t {
-			i++
-			if i == num && n == c {
+			if c == n {
 				return true
 			}
+			break
 		}
 	}
 
 	return false
 }
 
-func isNthChild(n *html.Node, d *ast.Dimension) bool {
+func isLastChild(n *html.Node) bool {
 	if n.Parent == nil {
 		return false
 	}
 
-	a := d.A
-	b := d.B
-
-	if d.Aop == "-" {
-		a = -a
-	}
-	if d.Bop == "-" {
-		b = -b
-	}
-
-	if d.A == 0 {
-		return isNChild(n, b)
-	}
-
-	i := 0
-	for c := n.Parent.FirstChild; c != nil; c = c.NextSibling {
+	for c := n.Parent.LastChild; c != nil; c = c.PrevSibling {
 		if c.Type == html.ElementNode {
-			i++
-			if (i-b)%a == 0 && i >= b && n == c {
+			if c == n {
 				return true
 			}
+			break
 		}
 	}
 
 	return false
 }
 
-func isNthLastChild(n *html.Node, d *ast.Dimension) bool {
+func isLastOfType(n *html.Node, t string) bool {
 	if n.Parent == nil {
 		return false
 	}
 
-	a := d.A
-	b := d.B
-
-	if d.Aop == "-" {
-		a = -a
-	}
-	if d.Bop == "-" {
-		b = -b
-	}
-
-	if d.A == 0 {
-		return isNLastChild(n, b)
-	}
-
-	i := 0
 	for c := n.Parent.LastChild; c != nil; c = c.PrevSibling {
-		if c.Type == html.ElementNode {
-			i++
-			if a < 0 {
-				if (i-b)%a == 0 && i <= b && n == c {
-					return true
-				}
-			} else {
-				if (i-b)%a == 0 && i >= b && n == c {
-					return true
-				}
+		if c.Type == html.ElementNode && c.Data == t {
+			if c == n {
+				return true
 			}
+			break
 		}
 	}
 
 	return false
 }
 
-func isNthOfType(n *html.Node, d *ast.Dimension, t string) bool {
+func isOnlyChlid(n *html.Node) bool {
 	if n.Parent == nil {
 		return false
 	}
 
-	a := d.A
-	b := d.B
-
-	if d.Aop == "-" {
-		a = -a
-	}
-	if d.Bop == "-" {
-		b = -b
-	}
-
-	if d.A == 0 || (a < 0 && d.A > 1) {
-		return isNOfType(n, b, t)
-	}
-
-	i := 0
+	cnt := 0
 	for c := n.Parent.FirstChild; c != nil; c = c.NextSibling {
-		if c.Type == html.ElementNode && c.Data == t {
-			i++
-			if a < 0 {
-				if a*(i-1)+b > 0 && n == c {
-					return true
-				}
-			} else {
-				if (i-b)%a == 0 && i >= b && n == c {
-					return true
-				}
-			}
+		if c.Type == html.ElementNode {
+			cnt++
 		}
 	}
 
-	return false
+	return cnt == 1
 }
 
-func isNthLastOfType(n *html.Node, d *ast.Dimension, t string) bool {
+func isOnlyOfType(n *html.Node, t string) bool {
 	if n.Parent == nil {
 		return false
 	}
 
-	a := d.A
-	b := d.B
-
-	if d.Aop == "-" {
-		a = -a
-	}
-	if d.Bop == "-" {
-		b = -b
-	}
-
-	if d.A == 0 || (a < 0 && d.A > 1) {
-		return isNLastOfType(n, b, t)
-	}
-
-	i := 0
-	for c := n.Parent.LastChild; c != nil; c = c.PrevSibling {
+	cnt := 0
+	for c := n.Parent.FirstChild; c != nil; c = c.NextSibling {
 		if c.Type == html.ElementNode && c.Data == t {
-			i++
-			if a < 0 {
-				if a*(i-1)+b > 0 && n == c {
-					return true
-				}
-			} else {
-				if (i-b)%a == 0 && i >= b && n == c {
-					return true
-				}
-			}
+			cnt++
 		}
 	}
 
-	return false
-}
-
-func isEvenChild(n *html.Node) bool {
-	d := &ast.Dimension{A: 2, Aop: "+"}
-	return isNthChild(n, d)
+	return cnt == 1
 }
 
-func isEvenLastChild(n *html.Node) bool {
-	d := &ast.Dimension{A: 2, Aop: "+"}
-	return isNthLastChild(n, d)
+// nthValues returns a and b of the An+B notation of arg.
+func nthValues(arg *ast.Arg) (int, int) {
+	switch arg.TypeID {
+	case 1:
+		a, b := arg.Dimension.A, arg.Dimension.B
+		if arg.Dimension.Aop == "-" {
+			a = -a
+		}
+		if arg.Dimension.Bop == "-" {
+			b = -b
+		}
+		return a, b
+	case 2:
+		return 0, arg.Number.Value
+	case 4:
+		if arg.Ident.Value == "even" {
+			return 2, 0
+		}
+		return 2, 1
+	}
+	return 0, 0
 }
 
-func isOddChild(n *html.Node) bool {
-	d := &ast.Dimension{A: 2, Aop: "+", B: 1, Bop: "+"}
-	return isNthChild(n, d)
+// isNth reports whether the 1-based index i is An+B for some n >= 0.
+func isNth(i, a, b int) bool {
+	if a == 0 {
+		return i == b
+	}
+	return (i-b)%a == 0 && (i-b)/a >= 0
 }
 
-func isOddLastChild(n *html.Node) bool {
-	d := &ast.Dimension{A: 2, Aop: "+", B: 1, Bop: "+"}
-	return isNthLastChild(n, d)
-}
+// nthIndex returns the 1-based index of n among its sibling elements,
+// counted from the last sibling if fromLast is true and among the siblings
+// of the same type if ofType is true. It returns 0 if n has no parent.
+func nthIndex(n *html.Node, fromLast, ofType bool) int {
+	if n.Parent == nil {
+		return 0
+	}
 
-func isEvenNthOfType(n *html.Node, t string) bool {
-	d := &ast.Dimension{A: 2, Aop: "+"}
-	return isNthOfType(n, d, t)
-}
+	counted := func(c *html.Node) bool {
+		return c.Type == html.ElementNode && (!ofType || c.Data == n.Data)
+	}
 
-func isOddNthOfType(n *html.Node, t string) bool {
-	d := &ast.Dimension{A: 2, Aop: "+", B: 1, Bop: "+"}
-	return isNthOfType(n, d, t)
+	i := 0
+	if fromLast {
+		for c := n.Parent.LastChild; c != nil; c = c.PrevSibling {
+			if counted(c) {
+				i++
+			}
+			if c == n {
+				return i
+			}
+		}
+	} else {
+		for c := n.Parent.FirstChild; c != nil; c = c.NextSibling {
+			if counted(c) {
+				i++
+			}
+			if c == n {
+				return i
+			}
+		}
+	}
+	return 0
 }
 
-func isEvenNthLastOfType(n *html.Node, t string) bool {
-	d := &ast.Dimension{A: 2, Aop: "+"}
-	return isNthLastOfType(n, d, t)
-}
+// nthIndexOf returns the 1-based index of n among its siblings in matched,
+// counted from the last sibling if fromLast is true.
+func nthIndexOf(n *html.Node, matched map[*html.Node]bool, fromLast bool) int {
+	if n.Parent == nil {
+		return 0
+	}
 
-func isOddNthLastOfType(n *html.Node, t string) bool {
-	d := &ast.Dimension{A: 2, Aop: "+", B: 1, Bop: "+"}
-	return isNthLastOfType(n, d, t)
+	i := 0
+	if fromLast {
+		for c := n.Parent.LastChild; c != nil; c = c.PrevSibling {
+			if matched[c] {
+				i++
+			}
+			if c == n {
+				return i
+			}
+		}
+	} else {
+		for c := n.Parent.FirstChild; c != nil; c = c.NextSibling {
+			if matched[c] {
+				i++
+			}
+			if c == n {
+				return i
+			}
+		}
+	}
+	return 0
 }
@@ -0,0 +1,348 @@
+package carrot
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/zzossig/carrot/eval"
+	"golang.org/x/net/html"
+	"gopkg.in/yaml.v3"
+)
+
+// Schema describes what Extract extracts from a document. It is meant to be
+// kept as configuration, so it can be loaded from JSON with ParseSchema
+// or from YAML with ParseSchemaYAML:
+//
+//	{"fields": [
+//		{"name": "title", "selector": "h1", "required": true},
+//		{"name": "tags", "selector": ".tags > li", "multiple": true, "transforms": ["lower"]},
+//		{"name": "items", "selector": ".item", "multiple": true, "fields": [
+//			{"name": "name", "selector": ".name"},
+//			{"name": "url", "selector": "a", "attr": "href"},
+//			{"name": "price", "selector": ".price", "transforms": ["regexp:[\\d.]+", "float"]}
+//		]}
+//	]}
+type Schema struct {
+	Fields []Field `json:"fields"`
+
+	compiled *compiledSchema // set by Validate
+}
+
+// compiledSchema keeps a copy of the fields a Schema was compiled from,
+// so Extract can tell if they were changed after Validate.
+type compiledSchema struct {
+	source []Field
+	fields []*compiledField
+}
+
+// Field is a value extracted by a Schema.
+type Field struct {
+	Name string `json:"name"`
+	// Selector selects the elements of the field within the scope of the
+	// enclosing field, like Find. An empty selector is the scope itself.
+	Selector string `json:"selector,omitempty"`
+	// Attr reads an attribute instead of the text.
+	Attr string `json:"attr,omitempty"`
+	// HTML reads the inner html instead of the text.
+	HTML bool `json:"html,omitempty"`
+	// Multiple extracts a list of all matches instead of the first match.
+	Multiple bool `json:"multiple,omitempty"`
+	// Required makes Extract fail if nothing matches.
+	Required bool `json:"required,omitempty"`
+	// Fields extracts an object from each match, selecting within the match.
+	Fields []Field `json:"fields,omitempty"`
+	// Transforms are applied to the value in order. They are trim, lower,
+	// upper, collapse (whitespace), regexp:<pattern> (the first submatch, or
+	// the match if there is no group), and int, float and bool which convert
+	// the value and have to come last.
+	Transforms []string `json:"transforms,omitempty"`
+}
+
+// SchemaError is returned for a Schema field that is invalid or fails to extract.
+type SchemaError struct {
+	Path     string // path of the field like "items.price"
+	Selector string // selector of the field
+	Err      error
+}
+
+func (e *SchemaError) Error() string {
+	if e.Selector == "" {
+		return fmt.Sprintf("schema field %q: %v", e.Path, e.Err)
+	}
+	return fmt.Sprintf("schema field %q (%s): %v", e.Path, e.Selector, e.Err)
+}
+
+func (e *SchemaError) Unwrap() error {
+	return e.Err
+}
+
+// ParseSchemaYAML parses a Schema from YAML and validates it.
+// The keys are the same as those of ParseSchema:
+//
+//	fields:
+//	  - name: title
+//	    selector: h1
+//	    required: true
+//	  - name: tags
+//	    selector: .tags > li
+//	    multiple: true
+func ParseSchemaYAML(data []byte) (*Schema, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("parsing schema: %w", err)
+	}
+
+	// the JSON decoder rejects unknown keys and values of the wrong type
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("parsing schema: %w", err)
+	}
+	return ParseSchema(data)
+}
+
+// ParseSchema parses a Schema from JSON and validates it.
+func ParseSchema(data []byte) (*Schema, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	var s Schema
+	if err := dec.Decode(&s); err != nil {
+		return nil, fmt.Errorf("parsing schema: %w", err)
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Validate checks that every field has a name, a selector that parses and
+// valid transforms. The error is a *SchemaError naming the first invalid field.
+// The compiled selectors are kept for Extract as long as the fields are not changed.
+func (s *Schema) Validate() error {
+	source := copyFields(s.Fields)
+	fields, err := compileFields(source, "")
+	if err != nil {
+		return err
+	}
+	s.compiled = &compiledSchema{source: source, fields: fields}
+	return nil
+}
+
+// copyFields returns a deep copy of fields.
+func copyFields(fields []Field) []Field {
+	if fields == nil {
+		return nil
+	}
+
+	cp := make([]Field, len(fields))
+	for i, f := range fields {
+		if f.Transforms != nil {
+			f.Transforms = append(make([]string, 0, len(f.Transforms)), f.Transforms...)
+		}
+		f.Fields = copyFields(f.Fields)
+		cp[i] = f
+	}
+	return cp
+}
+
+// Extract extracts the fields of schema from the descendants of n.
+// Single fields without a match are nil, multiple fields are empty lists.
+// The selectors of a schema from ParseSchema or Validate are compiled once,
+// unless its fields are changed afterwards. Others are compiled on each call.
+func Extract(n *html.Node, schema *Schema) (map[string]interface{}, error) {
+	if schema == nil {
+		return nil, errors.New("carrot: Extract needs a non-nil schema")
+	}
+
+	var fields []*compiledField
+	if c := schema.compiled; c != nil && reflect.DeepEqual(c.source, schema.Fields) {
+		fields = c.fields
+	} else {
+		var err error
+		if fields, err = compileFields(schema.Fields, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx := treeContext(n)
+	return extractFields(n, fields, ctx)
+}
+
+// compiledField is a Field with its selector and transforms compiled.
+type compiledField struct {
+	*Field
+	path       string
+	sel        *Selector
+	fields     []*compiledField
+	transforms []func(string) string
+	convert    func(string) (interface{}, error) // nil keeps the string
+}
+
+func compileFields(fields []Field, path string) ([]*compiledField, error) {
+	cfs := make([]*compiledField, len(fields))
+	names := make(map[string]bool)
+
+	for i := range fields {
+		f := &fields[i]
+		cf := &compiledField{Field: f, path: f.Name}
+		if path != "" {
+			cf.path = path + "." + f.Name
+		}
+		fail := func(err error) error {
+			return &SchemaError{Path: cf.path, Selector: f.Selector, Err: err}
+		}
+
+		if f.Name == "" {
+			return nil, fail(fmt.Errorf("field %d has no name", i))
+		}
+		if names[f.Name] {
+			return nil, fail(errors.New("duplicate field name"))
+		}
+		names[f.Name] = true
+
+		if strings.TrimSpace(f.Selector) != "" {
+			s, err := Compile(f.Selector)
+			if err != nil {
+				return nil, fail(err)
+			}
+			cf.sel = s
+		}
+
+		for j, name := range f.Transforms {
+			if conv, ok := conversions[name]; ok {
+				if j != len(f.Transforms)-1 {
+					return nil, fail(fmt.Errorf("transform %s has to be the last one", name))
+				}
+				cf.convert = conv
+				continue
+			}
+
+			t, err := compileTransform(name)
+			if err != nil {
+				return nil, fail(err)
+			}
+			cf.transforms = append(cf.transforms, t)
+		}
+
+		if len(f.Fields) > 0 {
+			if f.Attr != "" || f.HTML || len(f.Transforms) > 0 {
+				return nil, fail(errors.New("a field with fields cannot have attr, html or transforms"))
+			}
+			sub, err := compileFields(f.Fields, cf.path)
+			if err != nil {
+				return nil, err
+			}
+			cf.fields = sub
+		}
+
+		cfs[i] = cf
+	}
+
+	return cfs, nil
+}
+
+// conversions are the transforms that convert the value from a string.
+var conversions = map[string]func(string) (interface{}, error){
+	"int":   func(s string) (interface{}, error) { return strconv.Atoi(s) },
+	"float": func(s string) (interface{}, error) { return strconv.ParseFloat(s, 64) },
+	"bool":  func(s string) (interface{}, error) { return strconv.ParseBool(s) },
+}
+
+func compileTransform(name string) (func(string) string, error) {
+	switch {
+	case name == "trim":
+		return strings.TrimSpace, nil
+	case name == "lower":
+		return strings.ToLower, nil
+	case name == "upper":
+		return strings.ToUpper, nil
+	case name == "collapse":
+		return func(s string) string { return strings.Join(strings.Fields(s), " ") }, nil
+	case strings.HasPrefix(name, "regexp:"):
+		re, err := regexp.Compile(strings.TrimPrefix(name, "regexp:"))
+		if err != nil {
+			return nil, err
+		}
+		return func(s string) string {
+			m := re.FindStringSubmatch(s)
+			switch {
+			case m == nil:
+				return ""
+			case len(m) > 1:
+				return m[1]
+			default:
+				return m[0]
+			}
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown transform %q", name)
+}
+
+func extractFields(n *html.Node, fields []*compiledField, ctx *eval.Context) (map[string]interface{}, error) {
+	m := make(map[string]interface{}, len(fields))
+
+	for _, f := range fields {
+		nodes := []*html.Node{n}
+		if f.sel != nil {
+			nodes = eval.Find(n, f.sel.expr, ctx)
+		}
+		if len(nodes) == 0 && f.Required {
+			return nil, &SchemaError{Path: f.path, Selector: f.Selector, Err: errors.New("no element matched")}
+		}
+
+		if !f.Multiple {
+			if len(nodes) == 0 {
+				m[f.Name] = nil
+				continue
+			}
+			nodes = nodes[:1]
+		}
+
+		vs := make([]interface{}, 0, len(nodes))
+		for _, node := range nodes {
+			v, err := extractValue(node, f, ctx)
+			if err != nil {
+				return nil, err
+			}
+			vs = append(vs, v)
+		}
+
+		if f.Multiple {
+			m[f.Name] = vs
+		} else {
+			m[f.Name] = vs[0]
+		}
+	}
+
+	return m, nil
+}
+
+func extractValue(n *html.Node, f *compiledField, ctx *eval.Context) (interface{}, error) {
+	if f.fields != nil {
+		return extractFields(n, f.fields, ctx)
+	}
+
+	s, ok := nodeValue(n, fieldTag{attr: f.Attr, html: f.HTML})
+	if !ok {
+		return nil, nil
+	}
+
+	for _, t := range f.transforms {
+		s = t(s)
+	}
+	if f.convert == nil {
+		return s, nil
+	}
+
+	v, err := f.convert(s)
+	if err != nil {
+		return nil, &SchemaError{Path: f.path, Selector: f.Selector, Err: err}
+	}
+	return v, nil
+}
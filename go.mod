@@ -2,4 +2,8 @@ module github.com/zzossig/carrot
 
 go 1.16
 
-require golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4 // indirect
+require (
+	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4
+	golang.org/x/text v0.3.3
+	gopkg.in/yaml.v3 v3.0.1
+)
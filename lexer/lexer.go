@@ -1,17 +1,19 @@
 package lexer
 
 import (
-	"unicode"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/zzossig/carrot/token"
 )
 
-// Lexer reads input string one by one
+// Lexer reads input string one code point at a time
+// following https://www.w3.org/TR/css-syntax-3/#tokenization
 type Lexer struct {
 	input string // user input
 	pos   int    // current position within input
 	fPos  int    // following position
-	ch    byte   // current char under examination
+	ch    rune   // current char under examination
 }
 
 // New returns Lexer pointer
@@ -21,20 +23,52 @@ func New(input string) *Lexer {
 	return l
 }
 
-// PeekSpace checks if next char is space or not
+// PeekSpace checks if whitespace comes before the next token.
+// Comments are skipped, so `a /* x */ b` has whitespace but `a/* x */b` does not.
 func (l *Lexer) PeekSpace() bool {
-	return unicode.IsSpace(rune(l.ch))
+	i := l.pos
+	for i < len(l.input) {
+		switch {
+		case isSpace(rune(l.input[i])):
+			return true
+		case strings.HasPrefix(l.input[i:], "/*"):
+			end := strings.Index(l.input[i+2:], "*/")
+			if end < 0 {
+				return false
+			}
+			i += end + 4
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// Input returns the input string
+func (l *Lexer) Input() string {
+	return l.input
 }
 
 // NextToken returns next token by reading the input characters
 func (l *Lexer) NextToken() token.Token {
-	var tok token.Token
-
 	l.skipSpace()
 
+	pos := l.pos
+	tok := l.readToken()
+	tok.Pos = pos
+	return tok
+}
+
+func (l *Lexer) readToken() token.Token {
+	var tok token.Token
+
 	switch l.ch {
 	case '"', '\'':
-		tok = token.Token{Type: token.STRING, Literal: l.readString()}
+		str, ok := l.readString()
+		if !ok {
+			return token.Token{Type: token.ILLEGAL, Literal: str}
+		}
+		return token.Token{Type: token.STRING, Literal: str}
 	case '+':
 		tok = token.Token{Type: token.PLUS, Literal: "+"}
 	case '*':
@@ -45,7 +79,7 @@ func (l *Lexer) NextToken() token.Token {
 			tok = token.Token{Type: token.ASTERISK, Literal: "*"}
 		}
 	case '.':
-		if !isLetter(l.peekChar()) {
+		if !l.startsIdentAt(l.fPos) {
 			tok = token.Token{Type: token.ILLEGAL, Literal: string(l.ch)}
 		} else {
 			tok = token.Token{Type: token.DOT, Literal: "."}
@@ -100,24 +134,27 @@ func (l *Lexer) NextToken() token.Token {
 			tok = token.Token{Type: token.ILLEGAL, Literal: string(l.ch)}
 		}
 	case '@':
-		if !isLetter(l.peekChar()) {
+		if !l.startsIdentAt(l.fPos) {
 			tok = token.Token{Type: token.ILLEGAL, Literal: string(l.ch)}
 		} else {
 			l.readChar()
-			tok = token.Token{Type: token.ATKEYWORD, Literal: l.readIdent()}
+			tok = token.Token{Type: token.ATKEYWORD, Literal: l.readName()}
+			return tok
 		}
 	case '#':
-		if !isLetter(l.peekChar()) {
+		// a hash may start with a digit or an escape, e.g. #\31 23
+		if !isNameChar(l.peekChar()) && !isEscapeAt(l.input, l.fPos) {
 			tok = token.Token{Type: token.ILLEGAL, Literal: string(l.ch)}
 		} else {
 			l.readChar()
-			tok = token.Token{Type: token.HASH, Literal: l.readIdent()}
+			tok = token.Token{Type: token.HASH, Literal: l.readName()}
+			return tok
 		}
 	case 0:
 		tok = token.Token{Type: token.EOF, Literal: ""}
 	default:
-		if isLetter(l.ch) {
-			tok.Literal = l.readIdent()
+		if l.startsIdentAt(l.pos) {
+			tok.Literal = l.readName()
 			if l.ch == '(' {
 				l.readChar()
 				tok.Type = token.FUNCTION
@@ -125,10 +162,12 @@ func (l *Lexer) NextToken() token.Token {
 				tok.Type = token.IDENT
 			}
 			return tok
-		} else if isDigit(l.ch) {
+		} else if isDigit(l.ch) || l.ch == '-' && isDigit(l.peekChar()) {
 			tok.Literal = l.readNumber()
 			tok.Type = token.NUM
 			return tok
+		} else if l.ch == '-' {
+			tok = token.Token{Type: token.MINUS, Literal: "-"}
 		} else {
 			tok = token.Token{Type: token.ILLEGAL, Literal: string(l.ch)}
 		}
@@ -140,58 +179,203 @@ func (l *Lexer) NextToken() token.Token {
 
 func (l *Lexer) readChar() {
 	if l.fPos >= len(l.input) {
+		l.pos = len(l.input)
 		l.ch = 0
-	} else {
-		l.ch = l.input[l.fPos]
+		return
 	}
 	l.pos = l.fPos
-	l.fPos++
-}
 
-func (l *Lexer) peekChar() byte {
-	if l.fPos >= len(l.input) {
-		return 0
+	r, w := utf8.DecodeRuneInString(l.input[l.fPos:])
+	if r == 0 {
+		r = utf8.RuneError
 	}
-	return l.input[l.fPos]
+	l.ch = r
+	l.fPos += w
+}
+
+func (l *Lexer) peekChar() rune {
+	return runeAt(l.input, l.fPos)
 }
 
 func (l *Lexer) skipSpace() {
-	for unicode.IsSpace(rune(l.ch)) {
+	for {
+		switch {
+		case isSpace(l.ch):
+			l.readChar()
+		case l.ch == '/' && l.peekChar() == '*':
+			l.skipComment()
+		default:
+			return
+		}
+	}
+}
+
+// skipComment skips a comment. An unterminated comment runs to the end of the input.
+func (l *Lexer) skipComment() {
+	l.readChar()
+	l.readChar()
+	for l.ch != 0 && !(l.ch == '*' && l.peekChar() == '/') {
+		l.readChar()
+	}
+	if l.ch != 0 {
+		l.readChar()
 		l.readChar()
 	}
 }
 
-func (l *Lexer) readString() string {
-	pos := l.pos + 1
+// readString reads a string ending with the quote it started with.
+// It returns false if the string contains an unescaped newline.
+func (l *Lexer) readString() (string, bool) {
+	var sb strings.Builder
+	quote := l.ch
+	l.readChar()
+
 	for {
-		l.readChar()
-		if l.ch == '"' || l.ch == '\'' || l.ch == 0 {
-			break
+		switch l.ch {
+		case quote:
+			l.readChar()
+			return sb.String(), true
+		case 0:
+			return sb.String(), true
+		case '\n', '\r', '\f':
+			return sb.String(), false
+		case '\\':
+			l.readChar()
+			switch l.ch {
+			case 0:
+			case '\n', '\f':
+				l.readChar()
+			case '\r':
+				l.readChar()
+				if l.ch == '\n' {
+					l.readChar()
+				}
+			default:
+				sb.WriteRune(l.readEscape())
+			}
+		default:
+			sb.WriteRune(l.ch)
+			l.readChar()
 		}
 	}
-	return l.input[pos:l.pos]
 }
 
 func (l *Lexer) readNumber() string {
 	pos := l.pos
+	if l.ch == '-' {
+		l.readChar()
+	}
 	for isDigit(l.ch) {
 		l.readChar()
 	}
 	return l.input[pos:l.pos]
 }
 
-func (l *Lexer) readIdent() string {
-	pos := l.pos
-	for isLetter(l.ch) || isDigit(l.ch) {
+// readName consumes a name, replacing escapes with the code points they represent.
+func (l *Lexer) readName() string {
+	var sb strings.Builder
+	for {
+		switch {
+		case isNameChar(l.ch):
+			sb.WriteRune(l.ch)
+			l.readChar()
+		case isEscapeAt(l.input, l.pos):
+			l.readChar()
+			sb.WriteRune(l.readEscape())
+		default:
+			return sb.String()
+		}
+	}
+}
+
+// readEscape consumes an escaped code point. l.ch is the char following the backslash.
+func (l *Lexer) readEscape() rune {
+	if !isHex(l.ch) {
+		r := l.ch
 		l.readChar()
+		return r
 	}
-	return l.input[pos:l.pos]
+
+	var r rune
+	for i := 0; i < 6 && isHex(l.ch); i++ {
+		r = r*16 + hexVal(l.ch)
+		l.readChar()
+	}
+	if l.ch == '\r' && l.peekChar() == '\n' {
+		l.readChar()
+	}
+	if isSpace(l.ch) {
+		l.readChar()
+	}
+
+	if r == 0 || r > utf8.MaxRune || 0xD800 <= r && r <= 0xDFFF {
+		return utf8.RuneError
+	}
+	return r
+}
+
+// startsIdentAt checks if an ident sequence starts at byte offset i.
+func (l *Lexer) startsIdentAt(i int) bool {
+	r := runeAt(l.input, i)
+	switch {
+	case r == '-':
+		_, w := utf8.DecodeRuneInString(l.input[i:])
+		next := runeAt(l.input, i+w)
+		return isNameStart(next) || next == '-' || isEscapeAt(l.input, i+w)
+	case r == '\\':
+		return isEscapeAt(l.input, i)
+	default:
+		return isNameStart(r)
+	}
+}
+
+// isEscapeAt checks if a valid escape starts at byte offset i.
+func isEscapeAt(input string, i int) bool {
+	if runeAt(input, i) != '\\' {
+		return false
+	}
+	next := runeAt(input, i+1)
+	return next != '\n' && next != '\r' && next != '\f' && next != 0
+}
+
+func runeAt(input string, i int) rune {
+	if i >= len(input) {
+		return 0
+	}
+	r, _ := utf8.DecodeRuneInString(input[i:])
+	if r == 0 {
+		return utf8.RuneError
+	}
+	return r
 }
 
-func isLetter(ch byte) bool {
-	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '_' || ch == '-'
+func isNameStart(ch rune) bool {
+	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '_' || ch >= 0x80
 }
 
-func isDigit(ch byte) bool {
+func isNameChar(ch rune) bool {
+	return isNameStart(ch) || isDigit(ch) || ch == '-'
+}
+
+func isDigit(ch rune) bool {
 	return '0' <= ch && ch <= '9'
 }
+
+func isHex(ch rune) bool {
+	return isDigit(ch) || 'a' <= ch && ch <= 'f' || 'A' <= ch && ch <= 'F'
+}
+
+func hexVal(ch rune) rune {
+	switch {
+	case isDigit(ch):
+		return ch - '0'
+	case 'a' <= ch && ch <= 'f':
+		return ch - 'a' + 10
+	default:
+		return ch - 'A' + 10
+	}
+}
+
+func isSpace(ch rune) bool {
+	return ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' || ch == '\f'
+}
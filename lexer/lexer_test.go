@@ -28,6 +28,7 @@ func TestNextToken(t *testing.T) {
 		p:nth-child(2)
 		:nth-child(2n-1)
 		. class
+		#a.b#c)
 		`
 
 	tokens := []struct {
@@ -99,6 +100,11 @@ func TestNextToken(t *testing.T) {
 		{token.RPAREN, ")"},
 		{token.ILLEGAL, "."},
 		{token.IDENT, "class"},
+		{token.HASH, "a"},
+		{token.DOT, "."},
+		{token.IDENT, "b"},
+		{token.HASH, "c"},
+		{token.RPAREN, ")"},
 	}
 
 	lexer := New(input)
@@ -115,3 +121,79 @@ func TestNextToken(t *testing.T) {
 		}
 	}
 }
+
+func TestCSSSyntax(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []token.Token
+	}{
+		{`.日本`, []token.Token{{Type: token.DOT, Literal: "."}, {Type: token.IDENT, Literal: "日本"}}},
+		{`#\31 23`, []token.Token{{Type: token.HASH, Literal: "123"}}},
+		{`#1a`, []token.Token{{Type: token.HASH, Literal: "1a"}}},
+		{`.a\:b`, []token.Token{{Type: token.DOT, Literal: "."}, {Type: token.IDENT, Literal: "a:b"}}},
+		{`.sm\:p-4\.5`, []token.Token{{Type: token.DOT, Literal: "."}, {Type: token.IDENT, Literal: "sm:p-4.5"}}},
+		{`\64 iv`, []token.Token{{Type: token.IDENT, Literal: "div"}}},
+		{`\000000`, []token.Token{{Type: token.IDENT, Literal: "\uFFFD"}}},
+		{`-\31`, []token.Token{{Type: token.IDENT, Literal: "-1"}}},
+		{`--x`, []token.Token{{Type: token.IDENT, Literal: "--x"}}},
+		{`-6`, []token.Token{{Type: token.NUM, Literal: "-6"}}},
+		{`- 6`, []token.Token{{Type: token.MINUS, Literal: "-"}, {Type: token.NUM, Literal: "6"}}},
+		{`"it's"`, []token.Token{{Type: token.STRING, Literal: "it's"}}},
+		{`'say "hi"'`, []token.Token{{Type: token.STRING, Literal: `say "hi"`}}},
+		{`"a\"b"`, []token.Token{{Type: token.STRING, Literal: `a"b`}}},
+		{`"\26 B"`, []token.Token{{Type: token.STRING, Literal: "&B"}}},
+		{"\"a\\\nb\"", []token.Token{{Type: token.STRING, Literal: "ab"}}},
+		{"\"a\nb", []token.Token{{Type: token.ILLEGAL, Literal: "a"}, {Type: token.IDENT, Literal: "b"}}},
+		{`"open`, []token.Token{{Type: token.STRING, Literal: "open"}}},
+		{`a/* comment */b`, []token.Token{{Type: token.IDENT, Literal: "a"}, {Type: token.IDENT, Literal: "b"}}},
+		{`/**/p/* x`, []token.Token{{Type: token.IDENT, Literal: "p"}}},
+		{`\`, []token.Token{{Type: token.ILLEGAL, Literal: "\\"}}},
+	}
+
+	for _, tt := range tests {
+		l := New(tt.input)
+		for i, expected := range tt.expected {
+			tok := l.NextToken()
+			if tok.Type != expected.Type || tok.Literal != expected.Literal {
+				t.Errorf("%s: token[%d] - expected=%+v, got=%+v", tt.input, i, expected, tok)
+			}
+		}
+		if tok := l.NextToken(); tok.Type != token.EOF {
+			t.Errorf("%s: expected EOF, got=%+v", tt.input, tok)
+		}
+	}
+}
+
+func TestPeekSpace(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{`a b`, true},
+		{`a/* x */b`, false},
+		{`a/* x */ b`, true},
+		{`a /* x */b`, true},
+		{`a/* x`, false},
+	}
+
+	for _, tt := range tests {
+		l := New(tt.input)
+		l.NextToken()
+		if l.PeekSpace() != tt.expected {
+			t.Errorf("%s: expected PeekSpace()=%t", tt.input, tt.expected)
+		}
+	}
+}
+
+func TestTokenPos(t *testing.T) {
+	input := "div  > .日本/* x */#a\n[b=\"c\"]"
+	expected := []int{0, 5, 7, 8, 21, 24, 25, 26, 27, 30, 31}
+
+	l := New(input)
+	for i, pos := range expected {
+		tok := l.NextToken()
+		if tok.Pos != pos {
+			t.Errorf("token[%d] %q: expected pos=%d, got=%d", i, tok.Literal, pos, tok.Pos)
+		}
+	}
+}
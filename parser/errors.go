@@ -0,0 +1,118 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/zzossig/carrot/token"
+)
+
+// ParseError describes a syntax error in a selector.
+type ParseError struct {
+	Input    string       // selector being parsed
+	Offset   int          // byte offset of the offending token
+	Line     int          // 1-based line of the offending token
+	Column   int          // 1-based column of the offending token, counted in runes
+	Token    token.Token  // offending token
+	Expected []token.Type // token types that were expected instead, if known
+	Msg      string       // description of the error
+}
+
+func newParseError(input string, tok token.Token, expected []token.Type, msg string) *ParseError {
+	offset := tok.Pos
+	if offset > len(input) {
+		offset = len(input)
+	}
+
+	line := strings.Count(input[:offset], "\n") + 1
+	lineStart := strings.LastIndex(input[:offset], "\n") + 1
+	column := utf8.RuneCountInString(input[lineStart:offset]) + 1
+
+	return &ParseError{
+		Input:    input,
+		Offset:   offset,
+		Line:     line,
+		Column:   column,
+		Token:    tok,
+		Expected: expected,
+		Msg:      msg,
+	}
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parsing error at %d:%d: %s", e.Line, e.Column, e.Msg)
+}
+
+// Diagram renders the line of the selector containing the error
+// with a caret under the offending token.
+//
+//	div > [href=]
+//	            ^ expected ident or string, got "]"
+func (e *ParseError) Diagram() string {
+	lineStart := strings.LastIndex(e.Input[:e.Offset], "\n") + 1
+	lineEnd := strings.IndexByte(e.Input[e.Offset:], '\n')
+	if lineEnd < 0 {
+		lineEnd = len(e.Input)
+	} else {
+		lineEnd += e.Offset
+	}
+	line := e.Input[lineStart:lineEnd]
+
+	var sb strings.Builder
+	sb.WriteString(line)
+	sb.WriteString("\n")
+	// keep tabs so the caret lines up with the selector
+	for _, r := range e.Input[lineStart:e.Offset] {
+		if r == '\t' {
+			sb.WriteRune('\t')
+		} else {
+			sb.WriteRune(' ')
+		}
+	}
+
+	width := utf8.RuneCountInString(e.Token.Literal)
+	if max := utf8.RuneCountInString(line[e.Offset-lineStart:]); width > max {
+		width = max
+	}
+	if width < 1 {
+		width = 1
+	}
+	sb.WriteString(strings.Repeat("^", width))
+	sb.WriteString(" ")
+	sb.WriteString(e.Msg)
+
+	return sb.String()
+}
+
+// describe returns a readable form of tok for error messages.
+func describe(tok token.Token) string {
+	if tok.Type == token.EOF {
+		return "end of input"
+	}
+	return fmt.Sprintf("%q", tok.Literal)
+}
+
+// typeNames are readable names of token types that are not punctuation.
+var typeNames = map[token.Type]string{
+	token.EOF:       "end of input",
+	token.IDENT:     "ident",
+	token.STRING:    "string",
+	token.NUM:       "number",
+	token.FUNCTION:  "function",
+	token.HASH:      "hash",
+	token.ATKEYWORD: "at-keyword",
+}
+
+// joinTypes returns a readable form of ts like `ident or "]"`.
+func joinTypes(ts []token.Type) string {
+	strs := make([]string, len(ts))
+	for i, t := range ts {
+		if name, ok := typeNames[t]; ok {
+			strs[i] = name
+		} else {
+			strs[i] = fmt.Sprintf("%q", string(t))
+		}
+	}
+	return strings.Join(strs, " or ")
+}
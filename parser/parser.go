@@ -16,6 +16,32 @@ type (
 	infixParseFn  func(ast.Expression) ast.Expression
 )
 
+// Precedences of infix tokens. A selector list binds looser than combinators,
+// so "div p, a" is parsed as (div p), (a).
+const (
+	_ int = iota
+	LOWEST
+	GROUP      // ,
+	COMBINATOR // + > ~
+)
+
+var precedences = map[token.Type]int{
+	token.COMMA: GROUP,
+	token.PLUS:  COMBINATOR,
+	token.GT:    COMBINATOR,
+	token.TILDE: COMBINATOR,
+}
+
+var (
+	numRe      = regexp.MustCompile(`[0-9]+`)
+	opRe       = regexp.MustCompile(`[+-]+`)
+	argNumRe   = regexp.MustCompile("^[-+]?[0-9]+$")
+	argDimRe   = regexp.MustCompile(`^[-+]?[0-9]*[n]+[-+]?[0-9]*$`)
+	argIdentRe = regexp.MustCompile("^[A-Za-z]?[A-Za-z-_]*$")
+	case1Re    = regexp.MustCompile(`^[-+]?[0-9]*[A-Za-z]+$`)
+	case2Re    = regexp.MustCompile(`^[-+]?[A-Za-z]+[-+]?[0-9]+$`)
+)
+
 // Parser object
 type Parser struct {
 	l      *lexer.Lexer
@@ -46,6 +72,7 @@ func New(l *lexer.Lexer) *Parser {
 	p.prefixParseFns[token.DCOLON] = p.parseSequence
 	p.prefixParseFns[token.ASTERISK] = p.parseSequence
 	p.prefixParseFns[token.LBRACKET] = p.parseSequence
+	p.prefixParseFns[token.VBAR] = p.parseSequence
 	p.prefixParseFns[token.PLUS] = p.parseRSelector
 	p.prefixParseFns[token.GT] = p.parseRSelector
 	p.prefixParseFns[token.TILDE] = p.parseRSelector
@@ -65,14 +92,25 @@ func New(l *lexer.Lexer) *Parser {
 
 // ParseExpression is an entry point to parse expression
 func (p *Parser) ParseExpression() ast.Expression {
+	expr := p.parseExpression(LOWEST)
+	if len(p.errors) == 0 && !p.peekTokenIs(token.EOF) {
+		p.errorAt(p.peekToken, nil, "unexpected %s", describe(p.peekToken))
+	}
+	return expr
+}
+
+func (p *Parser) parseExpression(precedence int) ast.Expression {
 	prefix := p.prefixParseFns[p.curToken.Type]
 	if prefix == nil {
-		p.newError("no prefix parse function for %s found", p.curToken.Type)
+		// illegal tokens are reported by nextToken
+		if !p.curTokenIs(token.ILLEGAL) {
+			p.newError("unexpected %s", describe(p.curToken))
+		}
 		return nil
 	}
 	leftExp := prefix()
 
-	for !p.peekTokenIs(token.EOF) && !p.peekTokenIs(token.ILLEGAL) {
+	for !p.peekTokenIs(token.EOF) && !p.peekTokenIs(token.ILLEGAL) && precedence < p.peekPrecedence() {
 		infix := p.infixParseFns[p.peekToken.Type]
 		if infix == nil {
 			return leftExp
@@ -84,7 +122,7 @@ func (p *Parser) ParseExpression() ast.Expression {
 	}
 
 	if p.peekTokenIs(token.ILLEGAL) {
-		p.newError("parsing error: illegal token - %s", p.peekToken.Literal)
+		p.errorAt(p.peekToken, nil, "illegal token %s", describe(p.peekToken))
 		return nil
 	}
 
@@ -96,19 +134,24 @@ func (p *Parser) Errors() []error {
 	return p.errors
 }
 
+// newError records an error at the current token.
 func (p *Parser) newError(format string, a ...interface{}) {
-	p.errors = append(p.errors, fmt.Errorf(format, a...))
+	p.errorAt(p.curToken, nil, format, a...)
 }
 
-func (p *Parser) peekError(t token.Type) {
-	msg := fmt.Errorf("expected next token to be %s, got %s instead", t, p.peekToken.Type)
-	p.errors = append(p.errors, msg)
+// peekError records that the peek token is not one of ts.
+func (p *Parser) peekError(ts ...token.Type) {
+	p.errorAt(p.peekToken, ts, "expected %s, got %s", joinTypes(ts), describe(p.peekToken))
+}
+
+func (p *Parser) errorAt(tok token.Token, expected []token.Type, format string, a ...interface{}) {
+	p.errors = append(p.errors, newParseError(p.l.Input(), tok, expected, fmt.Sprintf(format, a...)))
 }
 
 func (p *Parser) nextToken() {
 	p.curToken = p.peekToken
 	if p.peekTokenIs(token.ILLEGAL) {
-		p.newError("parsing error: illegal token")
+		p.newError("illegal token %s", describe(p.curToken))
 	}
 	p.peekSpace = p.l.PeekSpace()
 	p.peekToken = p.l.NextToken()
@@ -125,6 +168,19 @@ func (p *Parser) peekTokenIs(t token.Type, ts ...token.Type) bool {
 	return p.peekToken.Type == t
 }
 
+func (p *Parser) peekPrecedence() int {
+	if pr, ok := precedences[p.peekToken.Type]; ok {
+		return pr
+	}
+	return LOWEST
+}
+
+// peekCombinator reports whether whitespace before the peek token is
+// a combinator rather than insignificant space around ',', ')' or EOF.
+func (p *Parser) peekCombinator() bool {
+	return p.peekSpace && !p.peekTokenIs(token.EOF, token.COMMA, token.RPAREN)
+}
+
 func (p *Parser) curTokenIs(t token.Type) bool {
 	return p.curToken.Type == t
 }
@@ -155,10 +211,8 @@ func (p *Parser) parseSequence() ast.Expression {
 	seq := &ast.Sequence{}
 
 	switch p.curToken.Type {
-	case token.IDENT:
-		seq.Expression = p.parseIdent()
-	case token.ASTERISK:
-		seq.Expression = p.parseUniversal()
+	case token.IDENT, token.ASTERISK, token.VBAR:
+		p.parseTypeSelector(seq)
 	case token.HASH:
 		seq.Exprs = append(seq.Exprs, p.parseHash())
 	case token.DOT:
@@ -171,18 +225,8 @@ func (p *Parser) parseSequence() ast.Expression {
 		seq.Exprs = append(seq.Exprs, p.parsePseudo())
 	}
 
-	if p.peekSpace {
-		if !p.peekTokenIs(token.EOF, token.PLUS, token.GT, token.TILDE) {
-			p.nextToken()
-			selector := &ast.Selector{Left: seq, Token: token.TokenMap("w")}
-			selector.Right = p.ParseExpression()
-			return selector
-		}
-		p.nextToken()
-		selector := &ast.Selector{Left: seq, Token: p.curToken}
-		p.nextToken()
-		selector.Right = p.ParseExpression()
-		return selector
+	if p.peekCombinator() {
+		return p.parseCombinator(seq)
 	}
 
 	return p.parseSimpleSequence(seq)
@@ -190,18 +234,8 @@ func (p *Parser) parseSequence() ast.Expression {
 
 func (p *Parser) parseSimpleSequence(seq *ast.Sequence) ast.Expression {
 	for p.peekTokenIs(token.HASH, token.DOT, token.LBRACKET, token.COLON, token.DCOLON) {
-		if p.peekSpace {
-			if !p.peekTokenIs(token.EOF, token.PLUS, token.GT, token.TILDE) {
-				p.nextToken()
-				selector := &ast.Selector{Left: seq, Token: token.TokenMap("w")}
-				selector.Right = p.ParseExpression()
-				return selector
-			}
-			p.nextToken()
-			selector := &ast.Selector{Left: seq, Token: p.curToken}
-			p.nextToken()
-			selector.Right = p.ParseExpression()
-			return selector
+		if p.peekCombinator() {
+			return p.parseCombinator(seq)
 		}
 
 		switch p.peekToken.Type {
@@ -222,9 +256,60 @@ func (p *Parser) parseSimpleSequence(seq *ast.Sequence) ast.Expression {
 		}
 	}
 
+	if p.peekCombinator() {
+		return p.parseCombinator(seq)
+	}
+
 	return seq
 }
 
+// parseCombinator parses the combinator following seq, which is either
+// whitespace (descendant) or one of + > ~ surrounded by whitespace.
+func (p *Parser) parseCombinator(seq *ast.Sequence) ast.Expression {
+	if !p.peekTokenIs(token.PLUS, token.GT, token.TILDE) {
+		p.nextToken()
+		selector := &ast.Selector{Left: seq, Token: token.TokenMap("w")}
+		selector.Right = p.parseExpression(GROUP)
+		return selector
+	}
+	p.nextToken()
+	selector := &ast.Selector{Left: seq, Token: p.curToken}
+	p.nextToken()
+	selector.Right = p.parseExpression(GROUP)
+	return selector
+}
+
+// parseTypeSelector parses a type selector or universal selector
+// with an optional namespace prefix into seq.
+func (p *Parser) parseTypeSelector(seq *ast.Sequence) {
+	seq.Namespace = p.parseNamespace()
+
+	switch p.curToken.Type {
+	case token.IDENT:
+		seq.Expression = p.parseIdent()
+	case token.ASTERISK:
+		seq.Expression = p.parseUniversal()
+	default:
+		p.errorAt(p.curToken, []token.Type{token.IDENT, token.ASTERISK}, "expected element name after namespace prefix, got %s", describe(p.curToken))
+	}
+}
+
+// parseNamespace parses a namespace prefix if there is one,
+// leaving the current token on the name that follows it.
+func (p *Parser) parseNamespace() *ast.Namespace {
+	switch {
+	case p.curTokenIs(token.VBAR):
+		p.nextToken()
+		return &ast.Namespace{}
+	case (p.curTokenIs(token.IDENT) || p.curTokenIs(token.ASTERISK)) && p.peekTokenIs(token.VBAR) && !p.peekSpace:
+		ns := &ast.Namespace{Prefix: p.curToken.Literal}
+		p.nextToken()
+		p.nextToken()
+		return ns
+	}
+	return nil
+}
+
 func (p *Parser) parseIdent() ast.Expression {
 	return &ast.Ident{Value: p.curToken.Literal}
 }
@@ -235,7 +320,6 @@ func (p *Parser) parseHash() ast.Expression {
 
 func (p *Parser) parseClass() ast.Expression {
 	if !p.expectPeek(token.IDENT) {
-		p.newError("parsing error: expectPeek=token.IDENT, got=%s", p.curToken.Type)
 		return nil
 	}
 
@@ -263,15 +347,46 @@ func (p *Parser) parsePseudo() ast.Expression {
 		} else if p.curToken.Literal == "has" {
 			has := &ast.Has{}
 			p.nextToken()
+			if p.curTokenIs(token.RPAREN) {
+				p.errorAt(p.curToken, nil, "empty :has() argument")
+				return nil
+			}
 			has.HArg = p.parseHArg()
 			if !p.expectPeek(token.RPAREN) {
 				return nil
 			}
 			return has
+		} else if p.curToken.Literal == "is" {
+			is := &ast.Is{}
+			is.Selectors = p.parseForgivingList()
+			if !p.expectPeek(token.RPAREN) {
+				return nil
+			}
+			return is
+		} else if p.curToken.Literal == "where" {
+			where := &ast.Where{}
+			where.Selectors = p.parseForgivingList()
+			if !p.expectPeek(token.RPAREN) {
+				return nil
+			}
+			return where
 		} else {
 			fp := &ast.FunctionalPseudo{Token: p.curToken}
 			p.nextToken()
 			fp.Arg = p.parseArg()
+			if fp.Arg == nil {
+				p.errorAt(fp.Token, nil, "invalid argument of %s()", fp.Token.Literal)
+				return nil
+			}
+			if strings.HasPrefix(fp.Token.Literal, "nth-") && fp.Arg.TypeID == 4 &&
+				fp.Arg.Ident.Value != "even" && fp.Arg.Ident.Value != "odd" {
+				p.errorAt(fp.Token, nil, "invalid argument of %s() - %s", fp.Token.Literal, fp.Arg.Ident.Value)
+				return nil
+			}
+			if fp.Arg.Of != nil && fp.Token.Literal != "nth-child" && fp.Token.Literal != "nth-last-child" {
+				p.errorAt(fp.Token, nil, "%s() does not take a selector list", fp.Token.Literal)
+				return nil
+			}
 			psd.FunctionalPseudo = fp
 			psd.TypeID = 2
 		}
@@ -280,12 +395,84 @@ func (p *Parser) parsePseudo() ast.Expression {
 			return nil
 		}
 	default:
-		p.errors = append(p.errors, fmt.Errorf("expected next token to be token.IDENT or token.FUNCTION, got %s instead", p.peekToken.Literal))
+		p.peekError(token.IDENT, token.FUNCTION)
 	}
 
 	return psd
 }
 
+// parseForgivingList parses a <forgiving-selector-list>.
+// The current token is the FUNCTION token, and parsing stops before the closing ')'.
+// Selectors that fail to parse and relative selectors are dropped along with their errors.
+func (p *Parser) parseForgivingList() []ast.Expression {
+	var sels []ast.Expression
+
+	for !p.peekTokenIs(token.RPAREN, token.EOF) {
+		nerr := len(p.errors)
+		p.nextToken()
+		if p.curTokenIs(token.COMMA) {
+			continue
+		}
+
+		state := p.save()
+		sel := p.parseExpression(GROUP)
+		// a relative selector is not a complex selector, so it is dropped like any invalid one
+		_, relative := sel.(*ast.RSelector)
+		if sel == nil || relative || len(p.errors) > nerr || !p.peekTokenIs(token.COMMA, token.RPAREN) {
+			p.restore(state)
+			p.skipArg()
+			p.errors = p.errors[:nerr]
+			continue
+		}
+
+		sels = append(sels, sel)
+	}
+
+	return sels
+}
+
+// skipArg advances to the last token before the next ',' or ')'
+// that is not nested in parentheses or brackets.
+func (p *Parser) skipArg() {
+	depth := 0
+	for {
+		switch p.curToken.Type {
+		case token.FUNCTION, token.LPAREN, token.LBRACKET:
+			depth++
+		case token.RPAREN, token.RBRACKET:
+			depth--
+		}
+		if p.peekTokenIs(token.EOF) || depth <= 0 && p.peekTokenIs(token.COMMA, token.RPAREN) {
+			return
+		}
+		p.nextToken()
+	}
+}
+
+// parserState is a snapshot of the parser used for backtracking.
+type parserState struct {
+	l         lexer.Lexer
+	curToken  token.Token
+	peekToken token.Token
+	peekSpace bool
+}
+
+func (p *Parser) save() parserState {
+	return parserState{
+		l:         *p.l,
+		curToken:  p.curToken,
+		peekToken: p.peekToken,
+		peekSpace: p.peekSpace,
+	}
+}
+
+func (p *Parser) restore(s parserState) {
+	*p.l = s.l
+	p.curToken = s.curToken
+	p.peekToken = s.peekToken
+	p.peekSpace = s.peekSpace
+}
+
 func (p *Parser) parseUniversal() ast.Expression {
 	return &ast.Universal{Token: p.curToken}
 }
@@ -297,7 +484,7 @@ func (p *Parser) parseGroup(left ast.Expression) ast.Expression {
 		g.Selectors = append(g.Selectors, left.Selectors...)
 
 		p.nextToken()
-		right := p.ParseExpression()
+		right := p.parseExpression(GROUP)
 		g.Selectors = append(g.Selectors, right)
 		return g
 	default:
@@ -305,7 +492,7 @@ func (p *Parser) parseGroup(left ast.Expression) ast.Expression {
 		g.Selectors = append(g.Selectors, left)
 
 		p.nextToken()
-		right := p.ParseExpression()
+		right := p.parseExpression(GROUP)
 
 		if r, ok := right.(*ast.Group); ok {
 			g.Selectors = append(g.Selectors, r.Selectors...)
@@ -321,7 +508,7 @@ func (p *Parser) parseSelector(left ast.Expression) ast.Expression {
 	s := &ast.Selector{Left: left, Token: p.curToken}
 
 	p.nextToken()
-	s.Right = p.ParseExpression()
+	s.Right = p.parseExpression(GROUP)
 
 	return s
 }
@@ -330,7 +517,7 @@ func (p *Parser) parseRSelector() ast.Expression {
 	rs := &ast.RSelector{Token: p.curToken}
 
 	p.nextToken()
-	rs.Expr = p.ParseExpression()
+	rs.Expr = p.parseExpression(GROUP)
 
 	return rs
 }
@@ -338,8 +525,10 @@ func (p *Parser) parseRSelector() ast.Expression {
 func (p *Parser) parseAttr() ast.Expression {
 	attr := &ast.Attrib{}
 
-	if !p.expectPeek(token.IDENT) {
-		p.newError("parsing error: expectPeek=token.IDENT, got=%s", p.curToken)
+	p.nextToken()
+	ns := p.parseNamespace()
+	if !p.curTokenIs(token.IDENT) {
+		p.errorAt(p.curToken, []token.Type{token.IDENT}, "expected attribute name, got %s", describe(p.curToken))
 		return nil
 	}
 
@@ -351,6 +540,22 @@ func (p *Parser) parseAttr() ast.Expression {
 		p.peekTokenIs(token.SUBSTRINGMATCH) {
 		ident := p.parseIdent().(*ast.Ident)
 		attr.AttrExpr = p.parseAttrExpr(ident)
+		if attr.AttrExpr == nil {
+			return nil
+		}
+		attr.Namespace = ns
+
+		if p.peekTokenIs(token.IDENT) {
+			p.nextToken()
+			switch m := strings.ToLower(p.curToken.Literal); m {
+			case "i", "s":
+				attr.Modifier = m
+			default:
+				p.errorAt(p.curToken, []token.Type{token.RBRACKET}, "unknown attribute modifier %s", describe(p.curToken))
+				return nil
+			}
+		}
+
 		if !p.expectPeek(token.RBRACKET) {
 			return nil
 		}
@@ -359,7 +564,7 @@ func (p *Parser) parseAttr() ast.Expression {
 	}
 
 	ident := p.parseIdent().(*ast.Ident)
-	attr.AttrExpr = &ast.AttrExpr{Left: ident, TypeID: 1}
+	attr.AttrExpr = &ast.AttrExpr{Left: ident, TypeID: 1, Namespace: ns}
 	if !p.expectPeek(token.RBRACKET) {
 		return nil
 	}
@@ -384,6 +589,9 @@ func (p *Parser) parseAttrExpr(left *ast.Ident) *ast.AttrExpr {
 		} else if p.curTokenIs(token.STRING) {
 			str := p.parseString().(*ast.Str)
 			ae.Right = &ast.Ident{Value: str.Value}
+		} else {
+			p.errorAt(p.curToken, []token.Type{token.IDENT, token.STRING}, "expected attribute value, got %s", describe(p.curToken))
+			return nil
 		}
 	default:
 		ae.TypeID = 1
@@ -393,175 +601,174 @@ func (p *Parser) parseAttrExpr(left *ast.Ident) *ast.AttrExpr {
 }
 
 func (p *Parser) parseArg() *ast.Arg {
-	arg := &ast.Arg{}
-
 	switch p.curToken.Type {
 	case token.STRING:
-		arg.TypeID = 3
+		arg := &ast.Arg{TypeID: 3}
 		arg.Str = p.parseString().(*ast.Str)
-		if !p.expectPeek(token.RPAREN) {
-			return nil
-		}
 		return arg
 	default:
 		var sb strings.Builder
 		for {
 			sb.WriteString(p.curToken.Literal)
-			if p.peekTokenIs(token.RPAREN) || p.peekTokenIs(token.EOF) {
+			if p.peekTokenIs(token.RPAREN) || p.peekTokenIs(token.EOF) || p.peekOf() {
 				break
 			}
 			p.nextToken()
 		}
 
-		str := sb.String()
-
-		numRe := regexp.MustCompile("^[-+]?[0-9]+$")
-		if numRe.MatchString(str) {
-			numMatch := regexp.MustCompile(`[0-9]+`)
-			opMatch := regexp.MustCompile(`[+-]+`)
+		arg := p.parseAnB(sb.String())
+		if arg != nil && p.peekOf() {
+			p.nextToken()
+			p.nextToken()
+			start := p.curToken
+			arg.Of = p.parseExpression(LOWEST)
+			if arg.Of == nil {
+				return nil
+			}
+			if isRelativeList(arg.Of) {
+				p.errorAt(start, nil, "relative selector is not allowed after of - %s", arg.Of)
+			}
+		}
 
-			nStr := numMatch.FindString(str)
-			opStr := opMatch.FindString(str)
+		return arg
+	}
+}
 
-			arg.TypeID = 2
-			num, _ := strconv.ParseInt(nStr, 0, 64)
-			if opStr == "-" {
-				arg.Number = &ast.Number{Value: -1 * int(num)}
-			} else {
-				arg.Number = &ast.Number{Value: int(num)}
+// isRelativeList reports whether e is a relative selector or a group holding one.
+func isRelativeList(e ast.Expression) bool {
+	if g, ok := e.(*ast.Group); ok {
+		for _, sel := range g.Selectors {
+			if _, ok := sel.(*ast.RSelector); ok {
+				return true
 			}
-
-			return arg
 		}
+		return false
+	}
+	_, ok := e.(*ast.RSelector)
+	return ok
+}
 
-		dimRe := regexp.MustCompile(`^[-+]?[0-9]*[n]+[-+]?[0-9]*$`)
-		if dimRe.MatchString(str) {
-			arg.TypeID = 1
-			arg.Dimension = p.parseDimension(str)
-			return arg
-		}
+// peekOf reports whether the peek token is the 'of' keyword of :nth-child(An+B of S).
+func (p *Parser) peekOf() bool {
+	return p.peekSpace && p.peekTokenIs(token.IDENT) && strings.EqualFold(p.peekToken.Literal, "of")
+}
+
+// parseAnB parses the concatenated tokens of an argument
+// into a number, a dimension or an ident.
+func (p *Parser) parseAnB(str string) *ast.Arg {
+	arg := &ast.Arg{}
 
-		identRe := regexp.MustCompile("^[A-Za-z]?[A-Za-z-_]*$")
-		if identRe.MatchString(str) {
-			arg.TypeID = 4
-			arg.Ident = &ast.Ident{Value: str}
-			return arg
+	if argNumRe.MatchString(str) {
+		nStr := numRe.FindString(str)
+		opStr := opRe.FindString(str)
+
+		arg.TypeID = 2
+		num, _ := strconv.ParseInt(nStr, 0, 64)
+		if opStr == "-" {
+			arg.Number = &ast.Number{Value: -1 * int(num)}
+		} else {
+			arg.Number = &ast.Number{Value: int(num)}
 		}
 
-		return nil
+		return arg
+	}
+
+	if argDimRe.MatchString(str) {
+		arg.TypeID = 1
+		arg.Dimension = p.parseDimension(str)
+		return arg
+	}
+
+	if argIdentRe.MatchString(str) {
+		arg.TypeID = 4
+		arg.Ident = &ast.Ident{Value: str}
+		return arg
 	}
+
+	return nil
 }
 
 func (p *Parser) parseNArg() *ast.NArg {
 	narg := &ast.NArg{}
-	var g ast.Expression
 
-	switch p.curToken.Type {
-	case token.IDENT:
-		if p.peekTokenIs(token.COLON) {
-			seq, ok := p.parseSequence().(*ast.Sequence)
-			if !ok {
-				p.newError("parsing error: not a valid selector")
-				return nil
-			}
-			narg.TypeID = 8
-			narg.Sequence = seq
-			g = narg.Sequence
-		} else {
-			narg.TypeID = 1
-			narg.Ident = p.parseIdent().(*ast.Ident)
-			g = narg.Ident
-		}
-	case token.ASTERISK:
-		if p.peekTokenIs(token.COLON) {
-			seq, ok := p.parseSequence().(*ast.Sequence)
-			if !ok {
-				p.newError("parsing error: not a valid selector")
-				return nil
-			}
-			narg.TypeID = 8
-			narg.Sequence = seq
-			g = narg.Sequence
-		} else {
-			narg.TypeID = 2
-			narg.Universal = p.parseUniversal().(*ast.Universal)
-			g = narg.Universal
-		}
-	case token.HASH:
-		narg.TypeID = 3
-		narg.Hash = p.parseHash().(*ast.Hash)
-		g = narg.Hash
-	case token.DOT:
-		if c := p.parseClass(); c != nil {
-			narg.TypeID = 4
-			narg.Class = c.(*ast.Class)
-			g = narg.Class
-		}
-	case token.LBRACKET:
-		if a := p.parseAttr(); a != nil {
-			narg.TypeID = 5
-			narg.Attrib = a.(*ast.Attrib)
-			g = narg.Attrib
-		}
-	case token.COLON:
-		if pd := p.parsePseudo(); pd != nil {
-			if pdTyped, ok := pd.(*ast.Pseudo); ok {
-				narg.TypeID = 6
-				narg.Pseudo = pdTyped
-				g = narg.Pseudo
-			}
-		}
+	start := p.curToken
+	g := p.parseExpression(GROUP)
+	if _, ok := g.(*ast.RSelector); ok {
+		p.errorAt(start, nil, "relative selector is not allowed in :not() - %s", g)
+		return narg
 	}
+	makeNArg(narg, g)
 
 	if p.peekTokenIs(token.COMMA) {
 		narg.TypeID = 7
 		for g != nil && p.peekTokenIs(token.COMMA) {
 			p.nextToken()
+			start = p.peekToken
 			narg.Group = p.parseGroup(g).(*ast.Group)
 			g = narg.Group
+
+			last := narg.Group.Selectors[len(narg.Group.Selectors)-1]
+			if _, ok := last.(*ast.RSelector); ok {
+				p.errorAt(start, nil, "relative selector is not allowed in :not() - %s", last)
+				return narg
+			}
 		}
 	}
 
 	return narg
 }
 
+// makeNArg stores e in narg. A sequence made of a single simple selector is
+// unwrapped, compound selectors are kept as a sequence.
+func makeNArg(narg *ast.NArg, e ast.Expression) {
+	if seq, ok := e.(*ast.Sequence); ok && seq.Namespace == nil {
+		switch {
+		case seq.Expression != nil && len(seq.Exprs) == 0:
+			e = seq.Expression
+		case seq.Expression == nil && len(seq.Exprs) == 1:
+			switch seq.Exprs[0].(type) {
+			case *ast.Hash, *ast.Class, *ast.Attrib, *ast.Pseudo:
+				e = seq.Exprs[0]
+			}
+		}
+	}
+
+	switch e := e.(type) {
+	case *ast.Ident:
+		narg.TypeID = 1
+		narg.Ident = e
+	case *ast.Universal:
+		narg.TypeID = 2
+		narg.Universal = e
+	case *ast.Hash:
+		narg.TypeID = 3
+		narg.Hash = e
+	case *ast.Class:
+		narg.TypeID = 4
+		narg.Class = e
+	case *ast.Attrib:
+		narg.TypeID = 5
+		narg.Attrib = e
+	case *ast.Pseudo:
+		narg.TypeID = 6
+		narg.Pseudo = e
+	case *ast.Sequence:
+		narg.TypeID = 8
+		narg.Sequence = e
+	case *ast.Selector:
+		narg.TypeID = 9
+		narg.Selector = e
+	}
+}
+
 func (p *Parser) parseHArg() *ast.HArg {
 	harg := &ast.HArg{}
 	var g ast.Expression
 
 	switch p.curToken.Type {
-	case token.IDENT:
-		harg.TypeID = 1
-		harg.Ident = p.parseIdent().(*ast.Ident)
-		g = harg.Ident
-	case token.ASTERISK:
-		harg.TypeID = 2
-		harg.Universal = p.parseUniversal().(*ast.Universal)
-		g = harg.Universal
-	case token.HASH:
-		harg.TypeID = 3
-		harg.Hash = p.parseHash().(*ast.Hash)
-		g = harg.Hash
-	case token.DOT:
-		if c := p.parseClass(); c != nil {
-			harg.TypeID = 4
-			harg.Class = c.(*ast.Class)
-			g = harg.Class
-		}
-	case token.LBRACKET:
-		if a := p.parseAttr(); a != nil {
-			harg.TypeID = 5
-			harg.Attrib = a.(*ast.Attrib)
-			g = harg.Attrib
-		}
-	case token.COLON:
-		if pd := p.parsePseudo(); pd != nil {
-			if pdTyped, ok := pd.(*ast.Pseudo); ok {
-				harg.TypeID = 6
-				harg.Pseudo = pdTyped
-				g = harg.Pseudo
-			}
-		}
+	case token.IDENT, token.ASTERISK, token.VBAR, token.HASH, token.DOT, token.LBRACKET, token.COLON:
+		g = p.parseSequence()
+		makeHArg(harg, g)
 	case token.PLUS:
 		fallthrough
 	case token.GT:
@@ -569,6 +776,7 @@ func (p *Parser) parseHArg() *ast.HArg {
 	case token.TILDE:
 		harg.TypeID = 8
 		harg.RSelector = p.parseRSelector().(*ast.RSelector)
+		g = harg.RSelector
 	}
 
 	if p.peekTokenIs(token.COMMA) {
@@ -583,14 +791,48 @@ func (p *Parser) parseHArg() *ast.HArg {
 	return harg
 }
 
+// makeHArg stores e in harg. A sequence made of a single simple selector is
+// unwrapped, anything more complex becomes a relative selector with the
+// descendant combinator.
+func makeHArg(harg *ast.HArg, e ast.Expression) {
+	if seq, ok := e.(*ast.Sequence); ok && seq.Namespace == nil {
+		switch {
+		case seq.Expression != nil && len(seq.Exprs) == 0:
+			e = seq.Expression
+		case seq.Expression == nil && len(seq.Exprs) == 1:
+			e = seq.Exprs[0]
+		}
+	}
+
+	switch e := e.(type) {
+	case *ast.Ident:
+		harg.TypeID = 1
+		harg.Ident = e
+	case *ast.Universal:
+		harg.TypeID = 2
+		harg.Universal = e
+	case *ast.Hash:
+		harg.TypeID = 3
+		harg.Hash = e
+	case *ast.Class:
+		harg.TypeID = 4
+		harg.Class = e
+	case *ast.Attrib:
+		harg.TypeID = 5
+		harg.Attrib = e
+	case *ast.Pseudo:
+		harg.TypeID = 6
+		harg.Pseudo = e
+	case nil:
+	default:
+		harg.TypeID = 8
+		harg.RSelector = &ast.RSelector{Expr: e, Token: token.TokenMap("w")}
+	}
+}
+
 func (p *Parser) parseDimension(str string) *ast.Dimension {
 	d := &ast.Dimension{}
 
-	numRe := regexp.MustCompile(`[0-9]+`)
-	opRe := regexp.MustCompile(`[+-]+`)
-
-	case1Re := regexp.MustCompile(`^[-+]?[0-9]*[A-Za-z]+$`)
-	case2Re := regexp.MustCompile(`^[-+]?[A-Za-z]+[-+]?[0-9]+$`)
 	if case1Re.MatchString(str) {
 		n1 := numRe.FindString(str)
 		op1 := opRe.FindString(str)
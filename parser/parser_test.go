@@ -1,9 +1,11 @@
 package parser
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/zzossig/carrot/lexer"
+	"github.com/zzossig/carrot/token"
 )
 
 func TestExpression(t *testing.T) {
@@ -16,31 +18,31 @@ func TestExpression(t *testing.T) {
 		{`'str'`, `"str"`},
 		{"h1", "h1"},
 		{"h1, h2, h3", "h1, h2, h3"},
-		{"*[hreflang|=en]", "*[hreflang|=en]"},
-		{"[hreflang|=en]", "[hreflang|=en]"},
+		{"*[hreflang|=en]", `*[hreflang|="en"]`},
+		{"[hreflang|=en]", `[hreflang|="en"]`},
 		{"*.warning", "*.warning"},
 		{".warning", ".warning"},
 		{"*#myid", "*#myid"},
 		{"#myid", "#myid"},
 		{"*", "*"},
 		{"[att]", "[att]"},
-		{"[att=val]", "[att=val]"},
-		{"[att~=val]", "[att~=val]"},
-		{"[att|=val]", "[att|=val]"},
-		{"[att^=val]", "[att^=val]"},
-		{"[att$=val]", "[att$=val]"},
-		{"[att*=val]", "[att*=val]"},
+		{"[att=val]", `[att="val"]`},
+		{"[att~=val]", `[att~="val"]`},
+		{"[att|=val]", `[att|="val"]`},
+		{"[att^=val]", `[att^="val"]`},
+		{"[att$=val]", `[att$="val"]`},
+		{"[att*=val]", `[att*="val"]`},
 		{"h1[title]", "h1[title]"},
-		{`span[class='example']`, `span[class=example]`},
-		{`span[hello="Cleveland"][goodbye="Columbus"]`, `span[hello=Cleveland][goodbye=Columbus]`},
-		{`a[rel~="copyright"]`, `a[rel~=copyright]`},
+		{`span[class='example']`, `span[class="example"]`},
+		{`span[hello="Cleveland"][goodbye="Columbus"]`, `span[hello="Cleveland"][goodbye="Columbus"]`},
+		{`a[rel~="copyright"]`, `a[rel~="copyright"]`},
 		{`p.pastoral.marine`, `p.pastoral.marine`},
 		{`.pastoral .marine`, `.pastoral .marine`},
 		{`.pastoral > .marine`, `.pastoral > .marine`},
 		{`.pastoral ~ .marine`, `.pastoral ~ .marine`},
 		{`.pastoral + .marine`, `.pastoral + .marine`},
-		{`.pastoral[a] .marine[b=c]`, `.pastoral[a] .marine[b=c]`},
-		{`.pastoral[a][x][z] .marine[b=c][y][z]`, `.pastoral[a][x][z] .marine[b=c][y][z]`},
+		{`.pastoral[a] .marine[b=c]`, `.pastoral[a] .marine[b="c"]`},
+		{`.pastoral[a][x][z] .marine[b=c][y][z]`, `.pastoral[a][x][z] .marine[b="c"][y][z]`},
 		{`h1#chapter1`, `h1#chapter1`},
 		{`#chapter1`, `#chapter1`},
 		{`*#z98y`, `*#z98y`},
@@ -85,19 +87,190 @@ func TestExpression(t *testing.T) {
 		{`math + p`, `math + p`},
 		{`h1.opener + h2`, `h1.opener + h2`},
 		{`h1 ~ pre`, `h1 ~ pre`},
-		{`H1 + *[REL=up]`, `H1 + *[REL=up]`},
+		{`H1 + *[REL=up]`, `H1 + *[REL="up"]`},
 		{`body *:not(h1,h2,h3,h4,h5,h6)`, `body *:not(h1, h2, h3, h4, h5, h6)`},
 		{`a:has(> img)`, `a:has(> img)`},
+		{`a:has(img)`, `a:has(img)`},
+		{`a:has( img.thumb )`, `a:has(img.thumb)`},
+		{`div:has(+ p, ~ h1)`, `div:has(+ p, ~ h1)`},
+		{`div:has(> p span, .foo)`, `div:has(> p span, .foo)`},
+		{`div:has(p > span)`, `div:has(p > span)`},
+		{`div p, a`, `div p, a`},
+		{`h1 , h2 `, `h1, h2`},
+		{`:is(h1, h2)`, `:is(h1, h2)`},
+		{`div:is(.a .b, p > span) em`, `div:is(.a .b, p > span) em`},
+		{`:where(nav a, .footer>p)`, `:where(nav a, .footer > p)`},
+		{`:is()`, `:is()`},
+		{`:is(h1, $, h2)`, `:is(h1, h2)`},
+		{`:is(h1, div:(a), h2)`, `:is(h1, h2)`},
+		{`:is(h1, [4], h2)`, `:is(h1, h2)`},
+		{`:where(.a..b)`, `:where()`},
+		{`:is(:is(a, b), c)`, `:is(:is(a, b), c)`},
+		{`*:is( > :first-child)`, `*:is()`},
+		{`:where(+ p)`, `:where()`},
+		{`:is(h1, ~ p, h2)`, `:is(h1, h2)`},
+		{`:where(> a, b > c)`, `:where(b > c)`},
+		{`a:has(:is(b, c))`, `a:has(:is(b, c))`},
+		{`p:not(p:first-child)`, `p:not(p:first-child)`},
+		{`a:not(nav a, .footer > p)`, `a:not(nav a, .footer > p)`},
+		{`a:not(.x.y)`, `a:not(.x.y)`},
+		{`a:not(:is(b, c))`, `a:not(:is(b, c))`},
+		{`a:not(:not(b))`, `a:not(:not(b))`},
+		{`[type="SUBMIT" i]`, `[type="SUBMIT" i]`},
+		{`[type=submit S ]`, `[type="submit" s]`},
+		{`svg|rect`, `svg|rect`},
+		{`*|*`, `*|*`},
+		{`|p`, `|p`},
+		{`svg|*.x`, `svg|*.x`},
+		{`[xlink|href]`, `[xlink|href]`},
+		{`[*|lang|=en]`, `[*|lang|="en"]`},
+		{`[|a="b" i]`, `[|a="b" i]`},
+		{`a:not(svg|rect)`, `a:not(svg|rect)`},
+		{`a:has(> math|mi)`, `a:has(> math|mi)`},
+		{`svg|svg > svg|g`, `svg|svg > svg|g`},
+		{`:nth-child(2n of .visible)`, `:nth-child(2n of .visible)`},
+		{`tr:nth-child(odd of li, .x > p)`, `tr:nth-child(odd of li, .x > p)`},
+		{`:nth-last-child( -n+3 OF p.x )`, `:nth-last-child(-n+3 of p.x)`},
+		{`:nth-child(2 of :not(.hidden))`, `:nth-child(2 of :not(.hidden))`},
+		{`:lang("fr")`, `:lang("fr")`},
+		{`:lang(of)`, `:lang(of)`},
+		{`.日本`, `.日本`},
+		{`#\31 23`, `#\31 23`},
+		{`.a\:b`, `.a\:b`},
+		{`.w-1\/2`, `.w-1\/2`},
+		{`[data-x="it's"]`, `[data-x="it's"]`},
+		{`d\69 v`, `div`},
+		{`a\:b`, `a\:b`},
+		{`[a\:b="x\"y\\z"]`, `[a\:b="x\"y\\z"]`},
+		{`[x='a"b']`, `[x="a\"b"]`},
+		{`.a\.b:not(#c\ d)`, `.a\.b:not(#c\ d)`},
+		{`svg\|x|a`, `svg\|x|a`},
+		{`div /* comment */ > p`, `div > p`},
+		{`ul/**/ li`, `ul li`},
 	}
 
 	for _, tt := range tests {
 		l := lexer.New(tt.input)
 		p := New(l)
 		e := p.ParseExpression()
+		if len(p.Errors()) > 0 {
+			t.Errorf("%s: unexpected errors: %v", tt.input, p.Errors())
+			continue
+		}
 
 		actual := e.String()
 		if actual != tt.expected {
 			t.Errorf("expected=%q, got=%q", tt.expected, actual)
 		}
+
+		// the serialized selector parses back to the same selector
+		p = New(lexer.New(actual))
+		if e := p.ParseExpression(); len(p.Errors()) > 0 || e.String() != actual {
+			t.Errorf("%s: does not parse back to the same selector. errors=%v", actual, p.Errors())
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []string{
+		`:not(> p)`,
+		`:not(a, > b)`,
+		`:not(a, + b)`,
+		`:not(a, b, ~ c)`,
+		`:not()`,
+		`:not(a, )`,
+		`:has()`,
+		`a:has( )`,
+		`:is(a`,
+		`[4]`,
+		`[a=]`,
+		`[a=b x]`,
+		`[a i]`,
+		`svg|`,
+		`svg|.a`,
+		`[svg|]`,
+		`:nth-of-type(2 of p)`,
+		`:nth-child(2 of)`,
+		`:nth-child(2 of ,)`,
+		`:nth-child(of p)`,
+		`:nth-child(2 of > p)`,
+		`:nth-last-child(odd of li, + p)`,
+		`:nth-child()`,
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt)
+		p := New(l)
+		p.ParseExpression()
+
+		if len(p.Errors()) == 0 {
+			t.Errorf("%s: expected parsing errors", tt)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		input    string
+		offset   int
+		line     int
+		column   int
+		literal  string
+		expected []token.Type
+		diagram  string
+	}{
+		{
+			"div > [href=]", 12, 1, 13, "]", []token.Type{token.IDENT, token.STRING},
+			"div > [href=]\n            ^ expected attribute value, got \"]\"",
+		},
+		{
+			"div,\n  p[a b]", 11, 2, 7, "b", []token.Type{token.RBRACKET},
+			"  p[a b]\n      ^ expected \"]\", got \"b\"",
+		},
+		{
+			"日本 > p:nth-of-type(2 of p)", 11, 1, 8, "nth-of-type", nil,
+			"日本 > p:nth-of-type(2 of p)\n       ^^^^^^^^^^^ nth-of-type() does not take a selector list",
+		},
+		{
+			"a:", 2, 1, 3, "", []token.Type{token.IDENT, token.FUNCTION},
+			"a:\n  ^ expected ident or function, got end of input",
+		},
+		{
+			"a:has()", 6, 1, 7, ")", nil,
+			"a:has()\n      ^ empty :has() argument",
+		},
+		{
+			"\tdiv p)", 6, 1, 7, ")", nil,
+			"\tdiv p)\n\t     ^ unexpected \")\"",
+		},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseExpression()
+		if len(p.Errors()) == 0 {
+			t.Errorf("%q: expected parsing errors", tt.input)
+			continue
+		}
+
+		pe, ok := p.Errors()[0].(*ParseError)
+		if !ok {
+			t.Errorf("%q: expected *ParseError, got=%T", tt.input, p.Errors()[0])
+			continue
+		}
+		if pe.Offset != tt.offset || pe.Line != tt.line || pe.Column != tt.column {
+			t.Errorf("%q: wrong position. got=%d %d:%d, expected=%d %d:%d",
+				tt.input, pe.Offset, pe.Line, pe.Column, tt.offset, tt.line, tt.column)
+		}
+		if pe.Token.Literal != tt.literal {
+			t.Errorf("%q: wrong token. got=%q, expected=%q", tt.input, pe.Token.Literal, tt.literal)
+		}
+		if !reflect.DeepEqual(pe.Expected, tt.expected) {
+			t.Errorf("%q: wrong expected set. got=%v, expected=%v", tt.input, pe.Expected, tt.expected)
+		}
+		if d := pe.Diagram(); d != tt.diagram {
+			t.Errorf("%q: wrong diagram. got=\n%s\nexpected=\n%s", tt.input, d, tt.diagram)
+		}
 	}
 }
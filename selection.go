@@ -0,0 +1,296 @@
+package carrot
+
+import (
+	"strings"
+
+	"github.com/zzossig/carrot/eval"
+	"golang.org/x/net/html"
+)
+
+// Selection is a set of elements of a document in document order.
+// Its methods return new Selections, so calls can be chained:
+//
+//	title := New().SetDoc("page.html").Query(".card").Filter(":has(.price)").Find("> h2").First().Text()
+//
+// Invalid selectors are recorded in the Errors of the CSS the Selection came from
+// and select nothing.
+type Selection struct {
+	Nodes []*html.Node
+	css   *CSS
+}
+
+// Query evaluates a css selector and returns the matched elements as a Selection.
+func (c *CSS) Query(input string) *Selection {
+	return c.selection(c.Eval(input))
+}
+
+// NewSelection returns a Selection of nodes, which must be elements of the same tree.
+// Selectors are evaluated against the whole tree.
+func NewSelection(nodes ...*html.Node) *Selection {
+	css := New()
+	if len(nodes) > 0 {
+		css.SetDocN(treeRoot(nodes[0]))
+	}
+	return css.selection(append([]*html.Node(nil), nodes...))
+}
+
+func (c *CSS) selection(nodes []*html.Node) *Selection {
+	return &Selection{Nodes: nodes, css: c}
+}
+
+// sorted returns a Selection of nodes in document order without duplicates.
+func (s *Selection) sorted(nodes []*html.Node) *Selection {
+	if len(nodes) > 1 {
+		nodes = eval.Sort(nodes, s.css.context)
+	}
+	return s.css.selection(nodes)
+}
+
+// Errors returns the errors of the CSS the Selection came from.
+func (s *Selection) Errors() []error {
+	return s.css.Errors()
+}
+
+// Len returns the number of elements in the Selection.
+func (s *Selection) Len() int {
+	return len(s.Nodes)
+}
+
+// Eq returns the i-th element as a Selection. A negative i counts from the last element.
+// The Selection is empty if i is out of range.
+func (s *Selection) Eq(i int) *Selection {
+	if i < 0 {
+		i += len(s.Nodes)
+	}
+	if i < 0 || i >= len(s.Nodes) {
+		return s.css.selection(nil)
+	}
+	return s.css.selection([]*html.Node{s.Nodes[i]})
+}
+
+// First returns the first element as a Selection.
+func (s *Selection) First() *Selection {
+	return s.Eq(0)
+}
+
+// Last returns the last element as a Selection.
+func (s *Selection) Last() *Selection {
+	return s.Eq(-1)
+}
+
+// Text returns the combined text of the elements and their descendants.
+func (s *Selection) Text() string {
+	var sb strings.Builder
+	for _, n := range s.Nodes {
+		writeText(&sb, n)
+	}
+	return sb.String()
+}
+
+// Attr returns the value of the attribute name of the first element.
+// It returns false if the Selection is empty or the element has no such attribute.
+func (s *Selection) Attr(name string) (string, bool) {
+	if len(s.Nodes) == 0 {
+		return "", false
+	}
+	return Attr(s.Nodes[0], name)
+}
+
+// HTML returns the inner html of the first element, or "" if the Selection is empty.
+func (s *Selection) HTML() (string, error) {
+	if len(s.Nodes) == 0 {
+		return "", nil
+	}
+	return InnerHTML(s.Nodes[0])
+}
+
+// Text returns the combined text of n and its descendants.
+// It reads n like Selection.Text without making a Selection.
+func Text(n *html.Node) string {
+	var sb strings.Builder
+	writeText(&sb, n)
+	return sb.String()
+}
+
+func writeText(sb *strings.Builder, n *html.Node) {
+	if n.Type == html.TextNode {
+		sb.WriteString(n.Data)
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		writeText(sb, c)
+	}
+}
+
+// Attr returns the value of the attribute name of n, which has no namespace.
+// It returns false if n has no such attribute.
+func Attr(n *html.Node, name string) (string, bool) {
+	for _, a := range n.Attr {
+		if a.Namespace == "" && a.Key == name {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+// InnerHTML returns the html of the children of n.
+func InnerHTML(n *html.Node) (string, error) {
+	var sb strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if err := html.Render(&sb, c); err != nil {
+			return "", err
+		}
+	}
+	return sb.String(), nil
+}
+
+// OuterHTML returns the html of n and its children.
+func OuterHTML(n *html.Node) (string, error) {
+	var sb strings.Builder
+	if err := html.Render(&sb, n); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// AttrOr is like Attr but returns def if there is no such attribute.
+func (s *Selection) AttrOr(name, def string) string {
+	if v, ok := s.Attr(name); ok {
+		return v
+	}
+	return def
+}
+
+// Parent returns the parent elements of the elements.
+// The root of the document is the parent of none of them, unless it is
+// the root element of a detached tree.
+func (s *Selection) Parent() *Selection {
+	var nodes []*html.Node
+	for _, n := range s.Nodes {
+		if p := n.Parent; p != nil && p.Type == html.ElementNode && (p != s.css.context.Doc || p.Parent == nil) {
+			nodes = append(nodes, p)
+		}
+	}
+	return s.sorted(nodes)
+}
+
+// Children returns the child elements of the elements.
+func (s *Selection) Children() *Selection {
+	var nodes []*html.Node
+	for _, n := range s.Nodes {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.ElementNode {
+				nodes = append(nodes, c)
+			}
+		}
+	}
+	return s.sorted(nodes)
+}
+
+// Next returns the next sibling elements of the elements.
+func (s *Selection) Next() *Selection {
+	var nodes []*html.Node
+	for _, n := range s.Nodes {
+		for c := n.NextSibling; c != nil; c = c.NextSibling {
+			if c.Type == html.ElementNode {
+				nodes = append(nodes, c)
+				break
+			}
+		}
+	}
+	return s.sorted(nodes)
+}
+
+// Prev returns the previous sibling elements of the elements.
+func (s *Selection) Prev() *Selection {
+	var nodes []*html.Node
+	for _, n := range s.Nodes {
+		for c := n.PrevSibling; c != nil; c = c.PrevSibling {
+			if c.Type == html.ElementNode {
+				nodes = append(nodes, c)
+				break
+			}
+		}
+	}
+	return s.sorted(nodes)
+}
+
+// Find returns the descendants of the elements matched by a css selector.
+// See CSS.Find for how the selector is matched.
+func (s *Selection) Find(input string) *Selection {
+	sel, ok := s.css.compile(input)
+	if !ok {
+		return s.css.selection(nil)
+	}
+
+	var nodes []*html.Node
+	for _, n := range s.Nodes {
+		nodes = append(nodes, eval.Find(n, sel.expr, s.css.context)...)
+	}
+	return s.sorted(nodes)
+}
+
+// Closest returns the closest elements matched by a css selector,
+// starting from each element and going up through its ancestors.
+func (s *Selection) Closest(input string) *Selection {
+	sel, ok := s.css.compile(input)
+	if !ok {
+		return s.css.selection(nil)
+	}
+
+	var nodes []*html.Node
+	for _, n := range s.Nodes {
+		if c := eval.Closest(n, sel.expr, s.css.context); c != nil {
+			nodes = append(nodes, c)
+		}
+	}
+	return s.sorted(nodes)
+}
+
+// Filter returns the elements matched by a css selector.
+// Like Matches, :scope matches each element in turn.
+func (s *Selection) Filter(input string) *Selection {
+	return s.filter(input, true)
+}
+
+// Not returns the elements not matched by a css selector.
+func (s *Selection) Not(input string) *Selection {
+	return s.filter(input, false)
+}
+
+func (s *Selection) filter(input string, keep bool) *Selection {
+	sel, ok := s.css.compile(input)
+	if !ok {
+		return s.css.selection(nil)
+	}
+
+	var nodes []*html.Node
+	for _, n := range s.Nodes {
+		if eval.Matches(n, sel.expr, s.css.context) == keep {
+			nodes = append(nodes, n)
+		}
+	}
+	return s.css.selection(nodes)
+}
+
+// Is reports whether any of the elements is matched by a css selector.
+func (s *Selection) Is(input string) bool {
+	return s.Filter(input).Len() > 0
+}
+
+// Each calls f for each element with its index and a Selection of the element.
+func (s *Selection) Each(f func(i int, s *Selection)) *Selection {
+	for i, n := range s.Nodes {
+		f(i, s.css.selection([]*html.Node{n}))
+	}
+	return s
+}
+
+// Map calls f for each element with its index and a Selection of the element
+// and returns the results.
+func (s *Selection) Map(f func(i int, s *Selection) string) []string {
+	strs := make([]string, len(s.Nodes))
+	for i, n := range s.Nodes {
+		strs[i] = f(i, s.css.selection([]*html.Node{n}))
+	}
+	return strs
+}
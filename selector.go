@@ -0,0 +1,161 @@
+package carrot
+
+import (
+	"fmt"
+
+	"github.com/zzossig/carrot/ast"
+	"github.com/zzossig/carrot/eval"
+	"github.com/zzossig/carrot/lexer"
+	"github.com/zzossig/carrot/parser"
+	"golang.org/x/net/html"
+)
+
+// Selector is a compiled css selector.
+// It can be reused across documents without parsing the selector again.
+type Selector struct {
+	selector string
+	expr     ast.Expression
+}
+
+// Compile parses a css selector and returns a Selector object.
+func Compile(sel string) (*Selector, error) {
+	s, errs := compile(sel)
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return s, nil
+}
+
+func compile(sel string) (*Selector, []error) {
+	l := lexer.New(sel)
+	p := parser.New(l)
+	pe := p.ParseExpression()
+
+	if len(p.Errors()) != 0 {
+		return nil, p.Errors()
+	}
+	if pe == nil {
+		return nil, []error{fmt.Errorf("parsing error: not a valid selector - %s", sel)}
+	}
+
+	return &Selector{selector: sel, expr: pe}, nil
+}
+
+// MustCompile is like Compile but panics if the selector cannot be parsed.
+func MustCompile(sel string) *Selector {
+	s, err := Compile(sel)
+	if err != nil {
+		panic(fmt.Sprintf("carrot: Compile(%q): %v", sel, err))
+	}
+	return s
+}
+
+// Select returns the descendants of n matched by the selector in document order.
+// A group of selectors is in document order as well: SetOrder applies only to
+// CSS.Select, so use New().SetDocN(n).SetOrder(SelectorOrder).Select(s) to get
+// the nodes of each selector in turn.
+func (s *Selector) Select(n *html.Node) []*html.Node {
+	ctx := eval.NewContext()
+	ctx.SetDocN(n)
+	return eval.Eval(s.expr, ctx)
+}
+
+// First returns the first descendant of n matched by the selector, or nil.
+func (s *Selector) First(n *html.Node) *html.Node {
+	nodes := s.Select(n)
+	if len(nodes) == 0 {
+		return nil
+	}
+	return nodes[0]
+}
+
+// Find returns the descendants of root matched by the selector in document order.
+// Unlike Select, the whole tree root belongs to is taken into account, so
+// ancestors of root can match. :scope matches root, and a selector starting
+// with a combinator like "> li" is relative to root.
+func (s *Selector) Find(root *html.Node) []*html.Node {
+	return eval.Find(root, s.expr, treeContext(root))
+}
+
+// Match reports whether n is matched by the selector.
+// The whole tree n belongs to is taken into account.
+// The selector is matched right to left from n, like browsers do,
+// and :scope matches n.
+func (s *Selector) Match(n *html.Node) bool {
+	return eval.Matches(n, s.expr, treeContext(n))
+}
+
+// Closest returns n or its nearest ancestor matched by the selector, or nil.
+// The whole tree n belongs to is taken into account, and :scope matches n.
+func (s *Selector) Closest(n *html.Node) *html.Node {
+	return eval.Closest(n, s.expr, treeContext(n))
+}
+
+// Matches reports whether n is matched by the css selector sel, like Element.matches.
+// An error is returned if sel cannot be parsed.
+func Matches(n *html.Node, sel string) (bool, error) {
+	s, err := Compile(sel)
+	if err != nil {
+		return false, err
+	}
+	return s.Match(n), nil
+}
+
+// Closest returns n or its nearest ancestor matched by the css selector sel,
+// or nil if there is none, like Element.closest.
+// An error is returned if sel cannot be parsed.
+func Closest(n *html.Node, sel string) (*html.Node, error) {
+	s, err := Compile(sel)
+	if err != nil {
+		return nil, err
+	}
+	return s.Closest(n), nil
+}
+
+// treeContext returns a context of the whole tree n belongs to.
+func treeContext(n *html.Node) *eval.Context {
+	ctx := eval.NewContext()
+	ctx.SetDocN(treeRoot(n))
+	return ctx
+}
+
+// treeRoot returns the root of the tree n belongs to.
+func treeRoot(n *html.Node) *html.Node {
+	for n.Parent != nil {
+		n = n.Parent
+	}
+	return n
+}
+
+// Expr returns the parsed selector.
+func (s *Selector) Expr() ast.Expression {
+	return s.expr
+}
+
+// Specificity returns the specificity of the selector, see ast.Specificity.
+// A group of selectors has the specificity of its most specific selector.
+func (s *Selector) Specificity() (a, b, c int) {
+	return ast.Specificity(s.expr)
+}
+
+// SortBySpecificity sorts selectors from the most specific to the least,
+// keeping the order of selectors with the same specificity.
+// Use ast.SortBySpecificity to sort the selectors of a parsed group.
+func SortBySpecificity(selectors []*Selector) {
+	exprs := make([]ast.Expression, len(selectors))
+	sels := make(map[ast.Expression]*Selector, len(selectors))
+	for i, s := range selectors {
+		exprs[i] = s.expr
+		sels[s.expr] = s
+	}
+
+	ast.SortBySpecificity(exprs)
+	for i, e := range exprs {
+		selectors[i] = sels[e]
+	}
+}
+
+// String returns the source of the selector.
+func (s *Selector) String() string {
+	return s.selector
+}
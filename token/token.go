@@ -4,6 +4,7 @@ package token
 type Token struct {
 	Type    Type
 	Literal string
+	Pos     int // byte offset of the token within the input
 }
 
 // Type represents Token Type
@@ -0,0 +1,299 @@
+package carrot
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zzossig/carrot/eval"
+	"golang.org/x/net/html"
+)
+
+// Unmarshaler is implemented by types that unmarshal themselves from the
+// elements selected by a field tag. A slice of Unmarshalers gets one element
+// per match, anything else gets all the matches.
+type Unmarshaler interface {
+	UnmarshalHTML(s *Selection) error
+}
+
+var (
+	unmarshalerType     = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	timeType            = reflect.TypeOf(time.Time{})
+)
+
+// Unmarshal fills the struct v points to from the descendants of n.
+// Fields are mapped by tags holding a css selector and options:
+//
+//	Title string    `carrot:"h1.title"`           // text of the first match
+//	Next  string    `carrot:"a.next,attr=href"`   // attribute of the first match
+//	Body  string    `carrot:"article,html"`       // inner html of the first match
+//	Tags  []string  `carrot:"li,text"`            // text of each match
+//	Price float64   `carrot:".price"`             // converted from the text
+//	Date  time.Time `carrot:"time,attr=datetime"` // parsed as RFC 3339
+//	Day   time.Time `carrot:"time,layout=Jan 2, 2006"`
+//	Items []Item    `carrot:".item"`              // fields of Item are selected from each match
+//	Link  string    `carrot:",attr=href"`         // an empty selector is the element itself
+//
+// Selectors are matched like Find, so they can see the ancestors of n and start with a combinator.
+// The text is trimmed. ints, uints, floats, bools, time.Time, encoding.TextUnmarshaler
+// and Unmarshaler are converted from it, pointers are allocated when there is a match.
+// Fields without a match or without the attribute are left unchanged.
+// layout has to be the last option, as it can contain commas.
+func Unmarshal(n *html.Node, v interface{}) error {
+	css := New().SetDocN(treeRoot(n))
+	return unmarshal(css, []*html.Node{n}, v)
+}
+
+// Unmarshal fills v from the elements of the Selection like the package function Unmarshal.
+// A slice gets one element per element of the Selection, a struct is filled from the first one.
+func (s *Selection) Unmarshal(v interface{}) error {
+	return unmarshal(s.css, s.Nodes, v)
+}
+
+func unmarshal(css *CSS, nodes []*html.Node, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("carrot: Unmarshal needs a non-nil pointer")
+	}
+
+	d := &decoder{css: css}
+	return d.decode(nodes, rv.Elem(), fieldTag{}, rv.Elem().Type().Name())
+}
+
+// fieldTag is a parsed carrot field tag.
+type fieldTag struct {
+	sel    string
+	attr   string // attribute to read instead of the text
+	html   bool   // read the inner html instead of the text
+	layout string // time layout, time.RFC3339 if empty
+}
+
+// parseTag splits a tag into the selector and the options following it.
+// Options are told apart from a group of selectors by the lack of a space after the comma.
+func parseTag(tag string) fieldTag {
+	ft := fieldTag{sel: tag}
+
+	parts := strings.Split(tag, ",")
+	for i := 1; i < len(parts); i++ {
+		if !isTagOption(parts[i]) {
+			continue
+		}
+
+		ft.sel = strings.Join(parts[:i], ",")
+		for j := i; j < len(parts); j++ {
+			opt := parts[j]
+			switch {
+			case opt == "text":
+			case opt == "html":
+				ft.html = true
+			case strings.HasPrefix(opt, "attr="):
+				ft.attr = strings.TrimPrefix(opt, "attr=")
+			case strings.HasPrefix(opt, "layout="):
+				ft.layout = strings.Join(parts[j:], ",")[len("layout="):]
+				return ft
+			}
+		}
+		return ft
+	}
+
+	return ft
+}
+
+func isTagOption(s string) bool {
+	return s == "text" || s == "html" || strings.HasPrefix(s, "attr=") || strings.HasPrefix(s, "layout=")
+}
+
+// structField is a field of a struct type with its tag parsed and its selector compiled.
+type structField struct {
+	index    int
+	name     string
+	embedded bool // an untagged embedded struct sharing the element
+	tag      fieldTag
+	sel      *Selector // nil for the element itself
+	err      error     // error compiling the selector
+}
+
+// structFields caches the fields of struct types, so the tags of a type
+// are parsed and compiled once.
+var structFields sync.Map // map[reflect.Type][]structField
+
+// fieldsOf returns the fields of the struct type t that Unmarshal fills.
+func fieldsOf(t reflect.Type) []structField {
+	if fs, ok := structFields.Load(t); ok {
+		return fs.([]structField)
+	}
+
+	var fs []structField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		tag, ok := f.Tag.Lookup("carrot")
+		if !ok {
+			if f.Anonymous && f.Type.Kind() == reflect.Struct {
+				fs = append(fs, structField{index: i, name: f.Name, embedded: true})
+			}
+			continue
+		}
+		if tag == "-" || f.PkgPath != "" {
+			continue
+		}
+
+		sf := structField{index: i, name: f.Name, tag: parseTag(tag)}
+		if strings.TrimSpace(sf.tag.sel) != "" {
+			sf.sel, sf.err = Compile(sf.tag.sel)
+		}
+		fs = append(fs, sf)
+	}
+
+	actual, _ := structFields.LoadOrStore(t, fs)
+	return actual.([]structField)
+}
+
+type decoder struct {
+	css *CSS
+}
+
+// decode stores the matched nodes in v. path names v in error messages.
+func (d *decoder) decode(nodes []*html.Node, v reflect.Value, ft fieldTag, path string) error {
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	if v.CanAddr() && v.Addr().Type().Implements(unmarshalerType) {
+		u := v.Addr().Interface().(Unmarshaler)
+		if err := u.UnmarshalHTML(d.css.selection(nodes)); err != nil {
+			return fmt.Errorf("carrot: unmarshaling %s: %w", path, err)
+		}
+		return nil
+	}
+
+	switch {
+	case v.Kind() == reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decode(nodes, v.Elem(), ft, path)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8:
+		s := reflect.MakeSlice(v.Type(), len(nodes), len(nodes))
+		for i, n := range nodes {
+			if err := d.decode([]*html.Node{n}, s.Index(i), ft, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+		return nil
+	case v.Kind() == reflect.Struct && v.Type() != timeType && !reflect.PtrTo(v.Type()).Implements(textUnmarshalerType):
+		return d.decodeStruct(nodes[0], v, path)
+	}
+
+	str, ok := nodeValue(nodes[0], ft)
+	if !ok {
+		return nil
+	}
+	if err := setValue(v, str, ft); err != nil {
+		return fmt.Errorf("carrot: cannot unmarshal %q into %s of type %s: %w", str, path, v.Type(), err)
+	}
+	return nil
+}
+
+// decodeStruct fills the fields of v from the descendants of n.
+func (d *decoder) decodeStruct(n *html.Node, v reflect.Value, path string) error {
+	for _, f := range fieldsOf(v.Type()) {
+		// untagged embedded structs share the element
+		if f.embedded {
+			if err := d.decodeStruct(n, v.Field(f.index), path); err != nil {
+				return err
+			}
+			continue
+		}
+
+		fpath := f.name
+		if path != "" {
+			fpath = path + "." + f.name
+		}
+		if f.err != nil {
+			return fmt.Errorf("carrot: selector of %s: %w", fpath, f.err)
+		}
+
+		nodes := []*html.Node{n}
+		if f.sel != nil {
+			nodes = eval.Find(n, f.sel.expr, d.css.context)
+		}
+		if err := d.decode(nodes, v.Field(f.index), f.tag, fpath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nodeValue returns the text, inner html or attribute of n selected by ft.
+func nodeValue(n *html.Node, ft fieldTag) (string, bool) {
+	switch {
+	case ft.attr != "":
+		return Attr(n, ft.attr)
+	case ft.html:
+		s, err := InnerHTML(n)
+		return s, err == nil
+	default:
+		return strings.TrimSpace(Text(n)), true
+	}
+}
+
+// setValue converts s to the type of v and stores it.
+func setValue(v reflect.Value, s string, ft fieldTag) error {
+	if v.Type() == timeType {
+		layout := ft.layout
+		if layout == "" {
+			layout = time.RFC3339
+		}
+		t, err := time.Parse(layout, s)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
+	if v.CanAddr() && v.Addr().Type().Implements(textUnmarshalerType) {
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Slice:
+		v.SetBytes([]byte(s))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return errors.New("unsupported type")
+	}
+	return nil
+}